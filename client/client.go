@@ -4,21 +4,31 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/larryhou/unity-gocache/server"
 	"hash"
 	"io"
 	rand2 "math/rand"
 	"net"
+	"strconv"
+	"time"
 )
 
 type Unity struct {
 	Addr   string
 	Port   int
+	Token  string // sent right after handshake if not empty
+	TLS    *tls.Config
 	Verify bool
 	Rand   *rand2.Rand
+	// Timeout bounds dialing and every read or write on the connection, 0 disables it
+	Timeout time.Duration
+	// Dial replaces dialing TCP if set
+	Dial   func(addr string) (net.Conn, error)
 	c      *server.Stream
 	b      [32 << 10]byte
 }
@@ -31,8 +41,13 @@ func (u *Unity) Close() error {
 }
 
 func (u *Unity) Connect() error {
-	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", u.Addr, u.Port))
+	addr := net.JoinHostPort(u.Addr, strconv.Itoa(u.Port))
+	var c net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: u.Timeout}
+	if u.Dial != nil { c, err = u.Dial(addr) } else if u.TLS != nil { c, err = tls.DialWithDialer(dialer, "tcp", addr, u.TLS) } else { c, err = dialer.Dial("tcp", addr) }
 	if err != nil {return err}
+	if u.Timeout > 0 { c = &deadlineConn{Conn: c, timeout: u.Timeout} }
 	u.c = &server.Stream{Rwp: c}
 	if err := u.c.Write([]byte{'f', 'e'}, 2); err != nil {return err}
 	ver := make([]byte, 8)
@@ -40,27 +55,63 @@ func (u *Unity) Connect() error {
 	if _, err := hex.Decode(ver, ver); err != nil {return err}
 	v := binary.BigEndian.Uint32(ver)
 	if v != 0x000000fe { return fmt.Errorf("version not match: %08x", v) }
+	if u.Token != "" {return u.Auth(u.Token)}
 	return nil
 }
 
-func (u *Unity) Get(id []byte, t server.RequestType, w io.Writer) error {
+// deadlineConn renews deadline before every read or write, so that a stalled peer fails a single chunk
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+var ErrAuth = errors.New("authentication failure")
+
+func (u *Unity) Auth(token string) error {
+	if err := u.c.Write([]byte{'a', 'u'}, 2); err != nil {return err}
+	if err := u.c.WriteString(u.b[:], token); err != nil {return err}
+	reply := u.b[:2]
+	if err := u.c.Read(reply, len(reply)); err != nil {return err}
+	if reply[0] != '+' || reply[1] != 'a' {return ErrAuth}
+	return nil
+}
+
+// Fetch sends a get request and reads the response header, it returns the body size or -1 on miss.
+// Exactly size bytes of body must be read from the connection before next request.
+func (u *Unity) Fetch(id []byte, t server.RequestType) (int64, error) {
 	b := bytes.NewBuffer(u.b[:0])
 	b.WriteByte('g')
 	b.WriteByte(byte(t))
 	b.Write(id[:32])
-	if err := u.c.Write(b.Bytes(), b.Len()); err != nil {return err}
+	if err := u.c.Write(b.Bytes(), b.Len()); err != nil {return 0, err}
 	cmd := u.b[:2]
-	if err := u.c.Read(cmd, len(cmd)); err != nil {return err}
+	if err := u.c.Read(cmd, len(cmd)); err != nil {return 0, err}
 	if cmd[0] == '-' {
-		return u.c.Read(u.b[:], 32)
+		return -1, u.c.Read(u.b[:], 32)
 	}
-	if cmd[0] != '+' || cmd[1] != byte(t) {return fmt.Errorf("get cmd not match: %s", string(cmd))}
+	if cmd[0] != '+' || cmd[1] != byte(t) {return 0, fmt.Errorf("get cmd not match: %s", string(cmd))}
 	sb := u.b[:16]
-	if err := u.c.Read(sb, len(sb)); err != nil {return err}
-	if _, err := hex.Decode(sb, sb); err != nil {return err}
+	if err := u.c.Read(sb, len(sb)); err != nil {return 0, err}
+	if _, err := hex.Decode(sb, sb); err != nil {return 0, err}
 	size := int64(binary.BigEndian.Uint64(sb))
-	if err := u.c.Read(u.b[:], 32); err != nil {return err}
-	if !bytes.Equal(u.b[:32], id) {return fmt.Errorf("cache id not match")}
+	if err := u.c.Read(u.b[:], 32); err != nil {return 0, err}
+	if !bytes.Equal(u.b[:32], id) {return 0, fmt.Errorf("cache id not match")}
+	return size, nil
+}
+
+func (u *Unity) Get(id []byte, t server.RequestType, w io.Writer) error {
+	size, err := u.Fetch(id, t)
+	if err != nil || size < 0 {return err}
 	read := int64(0)
 	for read < size {
 		num := int64(len(u.b))
@@ -91,7 +142,7 @@ func (u *Unity) Put(t server.RequestType, size int64, r io.Reader) error {
 		num := int64(len(u.b))
 		if size - sent < num { num = size - sent }
 		b := u.b[:num]
-		if n, err := r.Read(b); err != nil {return err} else {
+		if n, err := io.ReadFull(r, b); err != nil {return err} else {
 			sent += int64(n)
 			if err := u.c.Write(b, n); err != nil {return err}
 		}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/larryhou/unity-gocache/server"
+	"io"
+	"net"
+	"testing"
+)
+
+const hugeSize = int64(4<<30) + (1 << 20) + 17 // beyond both int32 and uint32
+
+var hugeTests = flag.Bool("huge", false, "run multi-GB transfer tests")
+
+// huge skips multi-GB transfers unless asked for by -huge, they take about a minute
+func huge(t *testing.T) {
+	if testing.Short() || !*hugeTests { t.Skip("multi-GB transfer, run with -huge") }
+}
+
+var pattern = func() []byte {
+	b := make([]byte, 64<<10 + 251)
+	for i := range b { b[i] = byte(i % 251) }
+	return b
+}()
+
+// generator streams a deterministic byte pattern without holding it in memory
+type generator struct {
+	size   int64
+	offset int64
+}
+
+func (g *generator) Read(p []byte) (int, error) {
+	if g.offset >= g.size {return 0, io.EOF}
+	if remain := g.size - g.offset; int64(len(p)) > remain { p = p[:remain] }
+	n := copy(p, pattern[g.offset%251:])
+	g.offset += int64(n)
+	return n, nil
+}
+
+// verifier checks written bytes against the generator pattern
+type verifier struct {
+	offset int64
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	for t := 0; t < len(p); {
+		b := p[t:]
+		if len(b) > 64<<10 { b = b[:64<<10] }
+		if !bytes.Equal(b, pattern[v.offset%251:][:len(b)]) {return t, fmt.Errorf("byte mismatch near %d", v.offset)}
+		v.offset += int64(len(b))
+		t += len(b)
+	}
+	return len(p), nil
+}
+
+func TestPutHuge(t *testing.T) {
+	huge(t)
+	u := (&pipes{s: &server.CacheServer{Path: t.TempDir()}}).connect(t)
+	id := bytes.Repeat([]byte{0xab}, 32)
+	sent := sha256.New()
+	if err := u.STrx(id); err != nil {t.Fatal(err)}
+	if err := u.Put(server.RequestTypeBin, hugeSize, io.TeeReader(&generator{size: hugeSize}, sent)); err != nil {t.Fatal(err)}
+	if err := u.ETrx(); err != nil {t.Fatal(err)}
+
+	/* stored artifact streams back whole */
+	var n Counter
+	got := sha256.New()
+	if err := u.Get(id, server.RequestTypeBin, io.MultiWriter(&n, got)); err != nil {t.Fatal(err)}
+	if int64(n) != hugeSize {t.Fatalf("size not match: %d != %d", n, hugeSize)}
+	if !bytes.Equal(got.Sum(nil), sent.Sum(nil)) {t.Fatal("sha256 not match")}
+}
+
+func TestGetHuge(t *testing.T) {
+	huge(t)
+	c, p := net.Pipe()
+	id := bytes.Repeat([]byte{0xcd}, 32)
+	go func() {
+		peer := &server.Stream{Rwp: p}
+		defer peer.Close()
+		buf := make([]byte, 64<<10)
+		if err := peer.Read(buf, 34); err != nil {return}
+		hdr := bytes.NewBuffer(nil)
+		hdr.WriteByte('+')
+		hdr.WriteByte(buf[1])
+		sb := make([]byte, 8)
+		binary.BigEndian.PutUint64(sb, uint64(hugeSize))
+		hdr.WriteString(hex.EncodeToString(sb))
+		hdr.Write(buf[2:34])
+		if err := peer.Write(hdr.Bytes(), hdr.Len()); err != nil {return}
+		io.CopyBuffer(p, &generator{size: hugeSize}, buf)
+	}()
+
+	u := &Unity{c: &server.Stream{Rwp: c}}
+	defer u.Close()
+	v := &verifier{}
+	if err := u.Get(id, server.RequestTypeBin, v); err != nil {t.Fatal(err)}
+	if v.offset != hugeSize {t.Fatalf("size not match: %d != %d", v.offset, hugeSize)}
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig builds a client config, ca replaces system roots and cert/key is presented to servers verifying clients
+func TLSConfig(ca string, cert string, key string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure, MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {return nil, err}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {return nil, fmt.Errorf("no certificate found in %s", ca)}
+		config.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {return nil, err}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/larryhou/unity-gocache/server"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue writes a certificate for 127.0.0.1 signed by parent, or a self-signed CA if parent is nil, under dir as name.crt/name.key
+func issue(t *testing.T, dir string, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {t.Fatal(err)}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil { signer, signerKey = parent.Leaf, parent.PrivateKey }
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {t.Fatal(err)}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {t.Fatal(err)}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {t.Fatal(err)}
+	if err := ioutil.WriteFile(filepath.Join(dir, name + ".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {t.Fatal(err)}
+	if err := ioutil.WriteFile(filepath.Join(dir, name + ".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {t.Fatal(err)}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca := issue(t, dir, "ca", nil)
+	cert := issue(t, dir, "server", &ca)
+	issue(t, dir, "client", &ca)
+	issue(t, dir, "untrusted", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	/* server verifies clients against the same CA */
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+	if err != nil {t.Fatal(err)}
+	defer l.Close()
+	s := &server.CacheServer{Path: t.TempDir()}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {return}
+			go s.Handle(c)
+		}
+	}()
+	connect := func(config *tls.Config) (*Unity, error) {
+		u := &Unity{Addr: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, TLS: config, Timeout: 5 * time.Second}
+		t.Cleanup(func() { u.Close() })
+		return u, u.Connect()
+	}
+
+	config, err := TLSConfig(file("ca.crt"), file("client.crt"), file("client.key"), false)
+	if err != nil {t.Fatal(err)}
+	u, err := connect(config)
+	if err != nil {t.Fatal(err)}
+	body := bytes.Repeat([]byte{0x71}, 100)
+	put(t, u, testID(0x71), body)
+	if b := get(t, u, testID(0x71)); !bytes.Equal(b, body) {t.Fatalf("got %d bytes", len(b))}
+
+	/* server certificate is verified unless insecure */
+	if config, err = TLSConfig("", file("client.crt"), file("client.key"), false); err != nil {t.Fatal(err)}
+	if _, err := connect(config); err == nil {t.Error("connected to server signed by unknown CA")}
+	if config, err = TLSConfig("", file("client.crt"), file("client.key"), true); err != nil {t.Fatal(err)}
+	if _, err := connect(config); err != nil {t.Errorf("insecure connect: %v", err)}
+	for _, pair := range [][2]string{{"", ""}, {"untrusted.crt", "untrusted.key"}} {
+		cert, key := pair[0], pair[1]
+		if cert != "" { cert, key = file(cert), file(key) }
+		if config, err = TLSConfig(file("ca.crt"), cert, key, false); err != nil {t.Fatal(err)}
+		if _, err := connect(config); err == nil {t.Errorf("connected with client certificate %q", pair[0])}
+	}
+
+	for _, args := range [][3]string{{file("ca.key"), "", ""}, {"", file("client.crt"), ""}, {"", file("client.crt"), file("ca.key")}, {file("missing.crt"), "", ""}} {
+		if _, err := TLSConfig(args[0], args[1], args[2], false); err == nil {t.Errorf("config %q accepted", args)}
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"github.com/larryhou/unity-gocache/server"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Upstream implements server.Upstream over a pool of connections to a parent cache server
+type Upstream struct {
+	Addr  string
+	Port  int
+	Token string
+	// Timeout bounds dialing and every read or write, a stalled parent would otherwise hang gets of the client
+	// waiting for it and shutdown draining them
+	Timeout time.Duration
+	// Dial replaces dialing TCP if set
+	Dial  func(addr string) (net.Conn, error)
+	idle  chan *Unity
+}
+
+func NewUpstream(addr string, conns int) (*Upstream, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {return nil, err}
+	p, err := strconv.Atoi(port)
+	if err != nil {return nil, err}
+	return &Upstream{Addr: host, Port: p, idle: make(chan *Unity, conns)}, nil
+}
+
+func (p *Upstream) acquire() (*Unity, bool, error) {
+	select {
+	case u := <-p.idle: return u, true, nil
+	default:
+		u := &Unity{Addr: p.Addr, Port: p.Port, Token: p.Token, Timeout: p.Timeout, Dial: p.Dial}
+		if err := u.Connect(); err != nil {
+			u.Close()
+			return nil, false, err
+		}
+		return u, false, nil
+	}
+}
+
+func (p *Upstream) release(u *Unity) {
+	select {
+	case p.idle <- u:
+	default: u.Close()
+	}
+}
+
+type body struct {
+	io.Reader
+	p *Upstream
+	u *Unity
+	n *io.LimitedReader
+}
+
+// Close returns the connection to pool once the body is fully read, otherwise the connection is out of sync and dropped
+func (b *body) Close() error {
+	if b.n.N == 0 {
+		b.p.release(b.u)
+		return nil
+	}
+	return b.u.Close()
+}
+
+func (p *Upstream) Get(id []byte, t server.RequestType) (io.ReadCloser, int64, error) {
+	u, pooled, err := p.acquire()
+	if err != nil {return nil, 0, err}
+	size, err := u.Fetch(id, t)
+	if err != nil {
+		u.Close()
+		if pooled {return p.Get(id, t)} /* idle connection may be closed by peer */
+		return nil, 0, err
+	}
+	if size < 0 {
+		p.release(u)
+		return nil, 0, server.ErrMiss
+	}
+	n := &io.LimitedReader{R: u.c.Rwp, N: size}
+	return &body{Reader: n, p: p, u: u, n: n}, size, nil
+}
+
+func (p *Upstream) Put(id []byte, artifacts []server.Artifact) error {
+	u, _, err := p.acquire()
+	if err != nil {return err}
+	if err := u.STrx(id); err != nil {
+		u.Close()
+		return err
+	}
+	for _, a := range artifacts {
+		if err := u.Put(a.Type, a.Size, a.Reader); err != nil {
+			u.Close()
+			return err
+		}
+	}
+	if err := u.ETrx(); err != nil {
+		u.Close()
+		return err
+	}
+	p.release(u)
+	return nil
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/larryhou/unity-gocache/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipes serves every dialed connection by a server over net.Pipe and counts dials
+type pipes struct {
+	s     *server.CacheServer
+	dials int32
+}
+
+func (p *pipes) dial(addr string) (net.Conn, error) {
+	atomic.AddInt32(&p.dials, 1)
+	c, s := net.Pipe()
+	go p.s.Handle(s)
+	return c, nil
+}
+
+func (p *pipes) connect(t *testing.T) *Unity {
+	u := &Unity{Dial: p.dial, Timeout: 5 * time.Second}
+	if err := u.Connect(); err != nil {t.Fatal(err)}
+	t.Cleanup(func() { u.Close() })
+	return u
+}
+
+func testID(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+func put(t *testing.T, u *Unity, id []byte, body []byte) {
+	if err := u.STrx(id); err != nil {t.Fatal(err)}
+	if err := u.Put(server.RequestTypeBin, int64(len(body)), bytes.NewReader(body)); err != nil {t.Fatal(err)}
+	if err := u.ETrx(); err != nil {t.Fatal(err)}
+}
+
+func get(t *testing.T, u *Unity, id []byte) []byte {
+	var b bytes.Buffer
+	if err := u.Get(id, server.RequestTypeBin, &b); err != nil {t.Fatal(err)}
+	return b.Bytes()
+}
+
+// family is a child server fetching from and forwarding to a parent, both reached over pipes
+func family(t *testing.T) (parent *pipes, child *pipes, parentPath string) {
+	parentPath = t.TempDir()
+	parent = &pipes{s: &server.CacheServer{Path: parentPath, Verify: true}}
+	up, err := NewUpstream("parent:9966", 4)
+	if err != nil {t.Fatal(err)}
+	up.Dial, up.Timeout = parent.dial, 5 * time.Second
+	child = &pipes{s: &server.CacheServer{Path: t.TempDir(), Verify: true, Upstream: up, UpstreamPut: true}}
+	return
+}
+
+func TestUpstreamRelay(t *testing.T) {
+	parent, child, parentPath := family(t)
+	p := parent.connect(t)
+	bodies := map[byte][]byte{}
+	for _, b := range []byte{1, 2, 3} {
+		bodies[b] = bytes.Repeat([]byte{b}, 100 << 10 + int(b))
+		put(t, p, testID(b), bodies[b])
+	}
+	get(t, p, testID(3)) /* puts are committed once it's answered */
+	dials := atomic.LoadInt32(&parent.dials)
+
+	c := child.connect(t)
+	for _, b := range []byte{1, 2, 3} {
+		if body := get(t, c, testID(b)); !bytes.Equal(body, bodies[b]) {t.Fatalf("relayed %d bytes not match", len(body))}
+	}
+	if n := atomic.LoadInt32(&parent.dials) - dials; n != 1 {t.Errorf("%d connections dialed for sequential gets, want 1 pooled", n)}
+
+	/* child serves its own copies once parent loses them */
+	if err := os.RemoveAll(parentPath); err != nil {t.Fatal(err)}
+	for _, b := range []byte{1, 2, 3} {
+		if body := get(t, c, testID(b)); !bytes.Equal(body, bodies[b]) {t.Fatalf("local copy of %d bytes not match", len(body))}
+	}
+}
+
+func TestUpstreamForward(t *testing.T) {
+	parent, child, _ := family(t)
+	body := bytes.Repeat([]byte{7}, 70 << 10)
+	c := child.connect(t)
+	put(t, c, testID(7), body)
+	get(t, c, testID(7))
+
+	p := parent.connect(t)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if got := get(t, p, testID(7)); bytes.Equal(got, body) {break}
+		if time.Now().After(deadline) {t.Fatal("upload never forwarded to parent")}
+	}
+}
+
+// stalled dials a parent which answers handshake and replies to a get with header and body of stall bytes at most, then hangs
+func stalled(t *testing.T, stall int) func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		c, p := net.Pipe()
+		t.Cleanup(func() { p.Close() })
+		go func() {
+			peer := &server.Stream{Rwp: p}
+			buf := make([]byte, 34)
+			if err := peer.Read(buf, 2); err != nil {return}
+			if err := peer.Write([]byte("000000fe"), 8); err != nil {return}
+			if stall < 0 {
+				io.Copy(ioutil.Discard, p)
+				return
+			}
+			if err := peer.Read(buf, 34); err != nil {return}
+			sb := make([]byte, 8)
+			binary.BigEndian.PutUint64(sb, uint64(stall + 1))
+			hdr := append([]byte{'+', buf[1]}, hex.EncodeToString(sb)...)
+			hdr = append(append(hdr, buf[2:34]...), make([]byte, stall)...)
+			if err := peer.Write(hdr, len(hdr)); err != nil {return}
+			io.Copy(ioutil.Discard, p)
+		}()
+		return c, nil
+	}
+}
+
+func TestUpstreamStalled(t *testing.T) {
+	for _, stall := range []int{-1, 1000} {
+		up, err := NewUpstream("parent:9966", 4)
+		if err != nil {t.Fatal(err)}
+		up.Dial, up.Timeout = stalled(t, stall), 200 * time.Millisecond
+		child := &pipes{s: &server.CacheServer{Path: t.TempDir(), Verify: true, Upstream: up}}
+		c := child.connect(t)
+		begin := time.Now()
+		var b bytes.Buffer
+		err = c.Get(testID(9), server.RequestTypeBin, &b)
+		if stall < 0 && (err != nil || b.Len() != 0) {t.Errorf("stalled header: want miss, got %d bytes, err %v", b.Len(), err)}
+		if stall >= 0 && err == nil {t.Errorf("stalled body: want error, got %d bytes", b.Len())}
+		if elapse := time.Since(begin); elapse > 3 * time.Second {t.Errorf("get took %v on stalled parent", elapse)}
+	}
+}
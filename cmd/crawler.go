@@ -1,6 +1,7 @@
 package main
 
 import (
+    "crypto/tls"
     "encoding/hex"
     "flag"
     "fmt"
@@ -26,6 +27,7 @@ type CrawlContext struct{
     device string
     addr string
     port int
+    tls *tls.Config
 }
 
 func main() {
@@ -40,8 +42,19 @@ func main() {
     flag.StringVar(&context.device, "device", "en0", "network interface for pcap")
     flag.IntVar(&context.index, "index", 0, "download index")
     flag.IntVar(&parallel, "parallel", 4, "parallel downloads")
+    var secure, insecure bool
+    var ca, cert, key string
+    flag.BoolVar(&secure, "tls", false, "connect over tls")
+    flag.StringVar(&ca, "tls-ca", "", "CA certificate to verify server with instead of system roots")
+    flag.StringVar(&cert, "tls-cert", "", "client certificate for servers verifying clients")
+    flag.StringVar(&key, "tls-key", "", "client certificate key")
+    flag.BoolVar(&insecure, "tls-insecure", false, "skip server certificate verification")
     flag.Parse()
 
+    if secure {
+        if v, err := client.TLSConfig(ca, cert, key, insecure); err != nil {panic(err)} else {context.tls = v}
+    }
+
     if len(context.output) == 0 {
         context.output = fmt.Sprintf("%s_%d", context.addr, context.port)
     }
@@ -125,7 +138,7 @@ func monitor(context *CrawlContext) {
 }
 
 func crawl(context *CrawlContext, group *sync.WaitGroup) {
-    c := client.Unity{Addr: context.addr, Port: context.port}
+    c := client.Unity{Addr: context.addr, Port: context.port, TLS: context.tls}
     if err := c.Connect(); err != nil {panic(err)}
     defer func() {
         c.Close()
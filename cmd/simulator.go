@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -27,6 +28,7 @@ var environ struct {
 	port    int
 	cmdPort int
 	verify  bool
+	tls     *tls.Config
 
 	queue   []*Context
 	library []*client.Entity
@@ -69,8 +71,19 @@ func main() {
 	flag.IntVar(&environ.cmdPort, "cmd-port", 19966, "local command server port")
 	flag.IntVar(&level, "log-level", -1, "log level debug=-1 info=0 warn=1 error=2 dpanic=3 panic=4 fatal=5")
 	flag.BoolVar(&environ.verify, "verify", true, "verify sha256")
+	var secure, insecure bool
+	var ca, cert, key string
+	flag.BoolVar(&secure, "tls", false, "connect over tls")
+	flag.StringVar(&ca, "tls-ca", "", "CA certificate to verify server with instead of system roots")
+	flag.StringVar(&cert, "tls-cert", "", "client certificate for servers verifying clients")
+	flag.StringVar(&key, "tls-key", "", "client certificate key")
+	flag.BoolVar(&insecure, "tls-insecure", false, "skip server certificate verification")
 	flag.Parse()
 
+	if secure {
+		if v, err := client.TLSConfig(ca, cert, key, insecure); err != nil {panic(err)} else {environ.tls = v}
+	}
+
 	if v, err := zap.NewDevelopment(zap.IncreaseLevel(zapcore.Level(level))); err != nil {panic(err)} else {logger = v}
 
 	environ.idle = make(chan *Context)
@@ -201,7 +214,7 @@ func handle(c net.Conn) {
 
 func addClients(num int) {
 	for i := 0; i < num; i++ {
-		u := &client.Unity{Addr: environ.addr, Port: environ.port, Verify: environ.verify, Rand: environ.rand}
+		u := &client.Unity{Addr: environ.addr, Port: environ.port, Verify: environ.verify, Rand: environ.rand, TLS: environ.tls}
 		if err := u.Connect(); err != nil {
 			u.Close()
 			go func() {
@@ -1,21 +1,117 @@
 package main
 
 import (
+    "context"
     "flag"
+    "fmt"
+    "github.com/larryhou/unity-gocache/client"
     "github.com/larryhou/unity-gocache/server"
     "net/http"
     _ "net/http/pprof"
+    "os"
+    "os/signal"
+    "path"
+    "syscall"
+    "time"
 )
 
 func main() {
     s := server.CacheServer{}
+    var upstream, upstreamToken, tokenFile, adminToken string
+    var drain, upstreamTimeout time.Duration
+    var s3Endpoint, s3Bucket, s3Region, s3Prefix string
+    var s3Timeout time.Duration
+    s3PartSize := int64(server.S3DefaultPartSize)
     flag.IntVar(&s.Port,"port", 9966, "server port")
     flag.StringVar(&s.Path, "path", "cache", "cache storage path")
     flag.IntVar(&s.LogLevel, "log-level", 0, "log level debug=-1 info=0 warn=1 error=2 dpanic=3 panic=4 fatal=5")
-    flag.IntVar(&s.CacheCap, "cache-cap", 0, "in-memory cache capacity")
+    flag.Var((*server.ByteSize)(&s.CacheCap), "cache-cap", "in-memory cache capacity in bytes with optional K/M/G/T suffix, e.g. 4G")
+    flag.Var((*server.ByteSize)(&s.DiskCap), "disk-cap", "on-disk cache capacity in bytes with optional K/M/G/T suffix, least recently used artifacts are evicted beyond it, 0 means unlimited")
+    flag.DurationVar(&s.TempAge, "temp-age", time.Hour, "remove temp upload files untouched for longer than this, 0 disables periodic sweeping")
+    flag.Var((*server.ByteSize)(&s.MinFreeDisk), "min-free-disk", "report not ready on /readyz once free space of cache path drops below it, 0 disables the check")
+    flag.BoolVar(&s.Verify, "verify", true, "verify artifact checksum before it's served the first time, corrupt ones are quarantined")
+    flag.StringVar(&s.TLSCert, "tls-cert", "", "serve over tls with this certificate, it's reloaded once modified")
+    flag.StringVar(&s.TLSKey, "tls-key", "", "tls certificate key, it's reloaded along with certificate")
+    flag.StringVar(&s.TLSClientCA, "tls-client-ca", "", "require clients to present certificates signed by this CA")
+    flag.DurationVar(&s.IdleTimeout, "idle-timeout", 0, "close connections without any command for this long, outstanding gets keep them alive, 0 disables it")
+    flag.DurationVar(&s.ChunkTimeout, "chunk-timeout", time.Minute, "close connections when a read or write within a command stalls for this long, 0 disables it")
+    flag.DurationVar(&s.TransferTimeout, "transfer-timeout", 0, "close connections when an artifact body takes longer than this to transfer, 0 disables it")
+    flag.IntVar(&s.MaxConns, "max-conns", 0, "maximum concurrent connections, 0 means unlimited")
+    flag.IntVar(&s.MaxConnsPerIP, "max-conns-per-ip", 0, "maximum concurrent connections from one remote ip, 0 means unlimited")
+    flag.DurationVar(&s.LimitWait, "limit-wait", 0, "how long over limit connections are queued for a free slot before rejected, 0 rejects them at once")
+    flag.Var((*server.ByteSize)(&s.Throttle.In), "throttle-in", "bytes per second received in uploads over all clients, 0 means unlimited")
+    flag.Var((*server.ByteSize)(&s.Throttle.Out), "throttle-out", "bytes per second sent in downloads over all clients, 0 means unlimited")
+    flag.Var((*server.ByteSize)(&s.Throttle.IPIn), "throttle-ip-in", "bytes per second received in uploads from every client ip, 0 means unlimited")
+    flag.Var((*server.ByteSize)(&s.Throttle.IPOut), "throttle-ip-out", "bytes per second sent in downloads to every client ip, 0 means unlimited")
+    flag.Var((*server.SubnetThrottles)(&s.Throttle.Subnets), "throttle-subnet", "bandwidth shared by clients of a subnet in form of cidr:in:out, e.g. 10.1.0.0/16:0:50M, repeat it for more subnets")
+    flag.Var(&s.Mode, "mode", "readwrite, readonly that drains and discards uploads, or writeonly that reports every get as a miss")
     flag.BoolVar(&s.DryRun, "dry-run", false, "dry run mode for profiling, don't use it in practise")
+    flag.Var(&s.Namespaces, "namespace", "serve a separate project namespace in form of name:port[:disk-cap] under <path>/<name>, repeat it for more namespaces")
+    flag.StringVar(&upstream, "upstream", "", "parent cache server host:port to fetch local misses from")
+    flag.StringVar(&upstreamToken, "upstream-token", "", "token to authenticate with upstream")
+    flag.DurationVar(&upstreamTimeout, "upstream-timeout", 10*time.Second, "bounds dialing upstream and every read or write from it, 0 disables it")
+    flag.StringVar(&tokenFile, "token-file", "", "file of <namespace> <ro|rw> <token> lines, namespaces listed in it require clients to authenticate")
+    flag.StringVar(&adminToken, "admin-token", os.Getenv("GOCACHE_ADMIN_TOKEN"), "bearer token of admin API served under /admin/ on :9999, which is disabled without it, defaults to GOCACHE_ADMIN_TOKEN")
+    flag.BoolVar(&s.UpstreamPut, "upstream-put", false, "forward uploads to upstream asynchronously")
+    flag.StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 compatible endpoint used with -s3-bucket, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+    flag.StringVar(&s3Bucket, "s3-bucket", "", "persist artifacts to this bucket and keep -path as a local read-through cache of it")
+    flag.StringVar(&s3Region, "s3-region", "us-east-1", "S3 bucket region")
+    flag.StringVar(&s3Prefix, "s3-prefix", "", "S3 object key prefix")
+    flag.Var((*server.ByteSize)(&s3PartSize), "s3-part-size", "S3 multipart upload part size, larger artifacts are uploaded in parts of this size, at least 5M")
+    flag.DurationVar(&s3Timeout, "s3-timeout", 30*time.Second, "bounds connecting to S3, waiting for its response headers and every read of a response body, 0 disables it")
+    flag.DurationVar(&drain, "drain-timeout", 30*time.Second, "how long in-flight transfers may take to finish on shutdown")
     flag.Parse()
 
+    if s3Bucket != "" {
+        s3, err := server.NewS3Storage(s3Endpoint, s3Bucket, s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), s3PartSize)
+        if err != nil { panic(err) }
+        s3.Prefix, s3.Timeout = s3Prefix, s3Timeout
+        s.Storage = server.NewTieredStorage(server.NewFileStorage(s.Path), s3)
+        for _, ns := range s.Namespaces {
+            remote := *s3
+            remote.Prefix += ns.Name + "/"
+            ns.Path = path.Join(s.Path, ns.Name)
+            ns.Storage = server.NewTieredStorage(server.NewFileStorage(ns.Path), &remote)
+        }
+    }
+    if upstream != "" {
+        u, err := client.NewUpstream(upstream, 16)
+        if err != nil { panic(err) }
+        u.Token = upstreamToken
+        u.Timeout = upstreamTimeout
+        s.Upstream = u
+    }
+    if tokenFile != "" {
+        f, err := os.Open(tokenFile)
+        if err != nil { panic(err) }
+        tokens, err := server.ParseTokens(f)
+        f.Close()
+        if err != nil { panic(err) }
+        s.Tokens = tokens["default"]
+        delete(tokens, "default")
+        for _, ns := range s.Namespaces {
+            ns.Tokens = tokens[ns.Name]
+            delete(tokens, ns.Name)
+        }
+        for name := range tokens { panic(fmt.Errorf("token file has unknown namespace %q", name)) }
+    }
+
+    http.HandleFunc("/metrics", server.ServeMetrics)
+    http.HandleFunc("/healthz", s.ServeHealth)
+    http.HandleFunc("/readyz", s.ServeReady)
+    if adminToken != "" { http.Handle("/admin/", s.Admin(adminToken)) }
     go http.ListenAndServe(":9999", nil)
-    if err := s.Listen(); err != nil { panic(err) }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        sig := make(chan os.Signal, 1)
+        signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+        <-sig
+        cancel()
+    }()
+    if err := s.Listen(ctx); err != nil && err != server.ErrServerClosed { panic(err) }
+
+    ctx, cancel = context.WithTimeout(context.Background(), drain)
+    defer cancel()
+    s.Shutdown(ctx)
 }
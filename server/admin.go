@@ -0,0 +1,305 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "go.uber.org/zap"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+var hexPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type adminArtifact struct {
+    Key      string    `json:"key"`
+    Size     int64     `json:"size"`
+    Mtime    time.Time `json:"mtime"`
+    Atime    time.Time `json:"atime"`
+    Tracked  bool      `json:"tracked"` // in disk index
+    Verified bool      `json:"verified"`
+    Memory   bool      `json:"memory"`
+}
+
+type adminEntry struct {
+    Key      string    `json:"key"`
+    Size     int64     `json:"size"`
+    Atime    time.Time `json:"atime"`
+    Verified bool      `json:"verified"`
+}
+
+type adminConnection struct {
+    Addr      string    `json:"addr"`
+    Namespace string    `json:"namespace"`
+    Since     time.Time `json:"since"`
+    Received  int64     `json:"received"`
+    Sent      int64     `json:"sent"`
+    Gets      int32     `json:"gets"` // get responses not sent yet
+    Busy      int32     `json:"busy"`
+}
+
+type adminRemoved struct {
+    Entries int   `json:"entries"`
+    Bytes   int64 `json:"bytes"`
+}
+
+// Admin serves the management API under /admin/, requests must carry header Authorization: Bearer <token>.
+//   GET    /admin/artifacts?namespace=&guid=&hash=   look an artifact up
+//   DELETE /admin/artifacts?namespace=&guid=[&hash=][&tier=local] delete artifacts of guid
+//   GET    /admin/entries?namespace=&offset=&limit=  list entries from the most recently used
+//   POST   /admin/purge?namespace=&age=24h[&tier=local] delete entries not accessed within age
+//   POST   /admin/evict?namespace=[&target=100G]     evict least recently used entries down to target
+//   POST   /admin/flush[?namespace=]                 flush in-memory cache
+//   GET    /admin/connections                        list active connections
+//   GET|PUT /admin/throttle                          report or replace bandwidth limits as JSON of Throttle
+// namespace defaults to default namespace. Deletes reach remote tier of tiered storage as well unless tier=local.
+func (s *CacheServer) Admin(token string) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/admin/artifacts", s.adminArtifacts)
+    mux.HandleFunc("/admin/entries", s.adminEntries)
+    mux.HandleFunc("/admin/purge", s.adminPurge)
+    mux.HandleFunc("/admin/evict", s.adminEvict)
+    mux.HandleFunc("/admin/flush", s.adminFlush)
+    mux.HandleFunc("/admin/connections", s.adminConnections)
+    mux.HandleFunc("/admin/throttle", s.adminThrottle)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if token == "" || !tokenEqual(r.Header.Get("Authorization"), "Bearer " + token) {
+            logger.Warn("admin unauthorized", zap.String("addr", r.RemoteAddr), zap.String("path", r.URL.Path))
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        mux.ServeHTTP(w, r)
+    })
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+    for _, m := range methods {
+        if r.Method == m {return true}
+    }
+    w.Header().Set("Allow", strings.Join(methods, ", "))
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return false
+}
+
+// adminNamespace finds namespace named in query, it fails until Listen opens namespaces
+func (s *CacheServer) adminNamespace(w http.ResponseWriter, r *http.Request) (*Namespace, bool) {
+    name := r.URL.Query().Get("namespace")
+    if name == "" { name = defaultNamespace }
+    s.Lock()
+    defer s.Unlock()
+    for _, ns := range s.spaces {
+        if ns.Name != name {continue}
+        if ns.disk == nil {break}
+        return ns, true
+    }
+    if s.listeners == nil {
+        http.Error(w, "server not listening", http.StatusServiceUnavailable)
+    } else { http.Error(w, fmt.Sprintf("namespace %q not found", name), http.StatusNotFound) }
+    return nil, false
+}
+
+func adminHex(w http.ResponseWriter, r *http.Request, name string, optional bool) (string, bool) {
+    v := strings.ToLower(r.URL.Query().Get(name))
+    if (v == "" && optional) || hexPattern.MatchString(v) {return v, true}
+    http.Error(w, fmt.Sprintf("%s must be 32 hex digits", name), http.StatusBadRequest)
+    return "", false
+}
+
+// adminTier tells whether deletes are meant for local tier only
+func adminTier(w http.ResponseWriter, r *http.Request) (bool, bool) {
+    switch r.URL.Query().Get("tier") {
+    case "", "all": return false, true
+    case "local": return true, true
+    }
+    http.Error(w, "tier must be all or local", http.StatusBadRequest)
+    return false, false
+}
+
+// remove deletes artifacts from storage, disk index and memory cache, remote copies of tiered storage
+// are kept only if local is set
+func (ns *Namespace) remove(keys []string, local bool) adminRemoved {
+    del := purgeArtifact
+    if local { del = removeArtifact }
+    var removed adminRemoved
+    for _, key := range keys {
+        size := int64(0)
+        if e, ok := ns.disk.lookup(key); ok { size = e.size } else if info, err := ns.store.Stat(key); err == nil { size = info.Size }
+        ns.disk.remove(key)
+        if e, t, ok := parseKey(key); ok { mcache.core.delete(ns.uuid(e, t)) }
+        remove := del
+        if strings.HasPrefix(key, quarantinePrefix) { remove = deleteQuarantined }
+        if err := remove(ns.store, key); err != nil {
+            if err != ErrMiss { logger.Error("admin remove err", zap.String("namespace", ns.Name), zap.String("key", key), zap.Error(err)) }
+            continue
+        }
+        removed.Entries++
+        removed.Bytes += size
+    }
+    return removed
+}
+
+func (s *CacheServer) adminArtifacts(w http.ResponseWriter, r *http.Request) {
+    if !allow(w, r, http.MethodGet, http.MethodDelete) {return}
+    ns, ok := s.adminNamespace(w, r)
+    if !ok {return}
+    guid, ok := adminHex(w, r, "guid", false)
+    if !ok {return}
+    hash, ok := adminHex(w, r, "hash", r.Method == http.MethodDelete)
+    if !ok {return}
+
+    types := []RequestType{RequestTypeBin, RequestTypeInf, RequestTypeRes}
+    if r.Method == http.MethodGet {
+        artifacts := []adminArtifact{}
+        for _, t := range types {
+            key := artifactKey(guid, hash, t)
+            info, err := ns.store.Stat(key)
+            if err != nil {
+                if err == ErrMiss {continue}
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            a := adminArtifact{Key: key, Size: info.Size, Mtime: info.Mtime, Memory: mcache.core.has(ns.uuid(Entity{guid: guid, hash: hash}, t))}
+            if e, ok := ns.disk.lookup(key); ok {
+                a.Tracked, a.Verified, a.Atime = true, e.verified, time.Unix(0, e.atime)
+            }
+            artifacts = append(artifacts, a)
+        }
+        if len(artifacts) == 0 {
+            http.Error(w, "artifact not found", http.StatusNotFound)
+            return
+        }
+        reply(w, artifacts)
+        return
+    }
+
+    local, ok := adminTier(w, r)
+    if !ok {return}
+    prefix := guid + "-" + hash
+    seen := map[string]bool{}
+    var keys []string
+    entities, _ := ns.disk.entries(0, -1)
+    for _, e := range entities {
+        if strings.HasPrefix(e.key, prefix) && !strings.HasSuffix(e.key, checksumExt) { keys, seen[e.key] = append(keys, e.key), true }
+    }
+    if hash != "" { /* artifacts not indexed yet */
+        for _, t := range types {
+            if key := artifactKey(guid, hash, t); !seen[key] { keys = append(keys, key) }
+        }
+    }
+    removed := ns.remove(keys, local)
+    logger.Info("admin delete", zap.String("namespace", ns.Name), zap.String("guid", guid), zap.String("hash", hash), zap.Int("entries", removed.Entries), zap.Int64("bytes", removed.Bytes))
+    reply(w, removed)
+}
+
+func (s *CacheServer) adminEntries(w http.ResponseWriter, r *http.Request) {
+    if !allow(w, r, http.MethodGet) {return}
+    ns, ok := s.adminNamespace(w, r)
+    if !ok {return}
+    offset, limit := 0, 1000
+    for name, v := range map[string]*int{"offset": &offset, "limit": &limit} {
+        q := r.URL.Query().Get(name)
+        if q == "" {continue}
+        n, err := strconv.Atoi(q)
+        if err != nil || n < 0 {
+            http.Error(w, fmt.Sprintf("%s must be a non-negative integer", name), http.StatusBadRequest)
+            return
+        }
+        *v = n
+    }
+    entities, total := ns.disk.entries(offset, limit)
+    entries := make([]adminEntry, 0, len(entities))
+    for _, e := range entities {
+        entries = append(entries, adminEntry{Key: e.key, Size: e.size, Atime: time.Unix(0, e.atime), Verified: e.verified})
+    }
+    reply(w, struct {
+        Total   int          `json:"total"`
+        Entries []adminEntry `json:"entries"`
+    }{total, entries})
+}
+
+func (s *CacheServer) adminPurge(w http.ResponseWriter, r *http.Request) {
+    if !allow(w, r, http.MethodPost) {return}
+    ns, ok := s.adminNamespace(w, r)
+    if !ok {return}
+    age, err := time.ParseDuration(r.URL.Query().Get("age"))
+    if err != nil || age <= 0 {
+        http.Error(w, "age must be a positive duration, e.g. 72h", http.StatusBadRequest)
+        return
+    }
+    local, ok := adminTier(w, r)
+    if !ok {return}
+    deadline := time.Now().Add(-age).UnixNano()
+    var keys []string
+    entities, _ := ns.disk.entries(0, -1)
+    for _, e := range entities {
+        if e.atime < deadline { keys = append(keys, e.key) }
+    }
+    removed := ns.remove(keys, local)
+    logger.Info("admin purge", zap.String("namespace", ns.Name), zap.Duration("age", age), zap.Int("entries", removed.Entries), zap.Int64("bytes", removed.Bytes))
+    reply(w, removed)
+}
+
+func (s *CacheServer) adminEvict(w http.ResponseWriter, r *http.Request) {
+    if !allow(w, r, http.MethodPost) {return}
+    ns, ok := s.adminNamespace(w, r)
+    if !ok {return}
+    target := ns.disk.low
+    if v := r.URL.Query().Get("target"); v != "" {
+        n, err := ParseByteSize(v)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        target = n
+    } else if ns.disk.capacity <= 0 {
+        http.Error(w, "namespace has no disk capacity, target is required", http.StatusBadRequest)
+        return
+    }
+    var removed adminRemoved
+    removed.Entries, removed.Bytes = ns.disk.evictTo(target)
+    logger.Info("admin evict", zap.String("namespace", ns.Name), zap.Int64("target", target), zap.Int("entries", removed.Entries), zap.Int64("bytes", removed.Bytes))
+    reply(w, removed)
+}
+
+func (s *CacheServer) adminFlush(w http.ResponseWriter, r *http.Request) {
+    if !allow(w, r, http.MethodPost) {return}
+    var removed adminRemoved
+    if r.URL.Query().Get("namespace") == "" {
+        removed.Entries, removed.Bytes = mcache.core.flush()
+    } else {
+        ns, ok := s.adminNamespace(w, r)
+        if !ok {return}
+        removed.Entries = mcache.core.drop(ns.Name + "/")
+    }
+    logger.Info("admin flush", zap.String("namespace", r.URL.Query().Get("namespace")), zap.Int("entries", removed.Entries))
+    reply(w, removed)
+}
+
+func (s *CacheServer) adminConnections(w http.ResponseWriter, r *http.Request) {
+    if !allow(w, r, http.MethodGet) {return}
+    s.Lock()
+    conns := make([]adminConnection, 0, len(s.conns))
+    for c := range s.conns {
+        conns = append(conns, adminConnection{
+            Addr:      c.RemoteAddr().String(),
+            Namespace: c.ns.Name,
+            Since:     c.since,
+            Received:  atomic.LoadInt64(&c.received),
+            Sent:      atomic.LoadInt64(&c.sent),
+            Gets:      atomic.LoadInt32(&c.gets),
+            Busy:      atomic.LoadInt32(&c.busy),
+        })
+    }
+    s.Unlock()
+    sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+    reply(w, conns)
+}
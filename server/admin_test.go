@@ -0,0 +1,135 @@
+package server
+
+import (
+    "bytes"
+    "encoding/hex"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// adminCall sends a request with token to admin API and decodes JSON reply into v unless it's nil
+func adminCall(t *testing.T, admin http.Handler, token string, method string, target string, v interface{}) int {
+    t.Helper()
+    r := httptest.NewRequest(method, target, nil)
+    if token != "" { r.Header.Set("Authorization", "Bearer " + token) }
+    w := httptest.NewRecorder()
+    admin.ServeHTTP(w, r)
+    if w.Code == http.StatusOK && v != nil {
+        if err := json.NewDecoder(w.Body).Decode(v); err != nil { t.Fatalf("%s %s: %v", method, target, err) }
+    }
+    return w.Code
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+    s := &CacheServer{}
+    paths := []string{"/admin/artifacts", "/admin/entries", "/admin/purge", "/admin/evict", "/admin/flush", "/admin/connections", "/admin/throttle"}
+    for _, path := range paths {
+        for _, token := range []string{"", "wrong", "secret-but-longer"} {
+            if code := adminCall(t, s.Admin("secret"), token, http.MethodGet, path, nil); code != http.StatusUnauthorized { t.Errorf("%s with token %q: %d", path, token, code) }
+        }
+        /* admin API without token is disabled */
+        if code := adminCall(t, s.Admin(""), "", http.MethodGet, path, nil); code != http.StatusUnauthorized { t.Errorf("%s without admin token: %d", path, code) }
+    }
+}
+
+func TestAdminCache(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) { s.CacheCap = 1 << 20 })
+    h.server.listeners = []net.Listener{}
+    admin := h.server.Admin("secret")
+    call := func(method, target string, v interface{}) {
+        t.Helper()
+        if code := adminCall(t, admin, "secret", method, target, v); code != http.StatusOK { t.Fatalf("%s %s: %d", method, target, code) }
+    }
+    var log bytes.Buffer
+    s := h.connect(&log)
+    var ids []string
+    for _, b := range []byte{0x81, 0x82, 0x83} {
+        id := testEntity(b)
+        s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(hit(RequestTypeBin, id, testBody(RequestTypeBin, id)))
+        ids = append(ids, id)
+    }
+    s.send(getCmd(RequestTypeBin, testEntity(0x80))) /* previous gets are closed once it's answered */
+    s.expect(miss(RequestTypeBin, testEntity(0x80)))
+    key := func(id string) string { return artifactKey(hex.EncodeToString([]byte(id[:16])), hex.EncodeToString([]byte(id[16:])), RequestTypeBin) }
+    uuid := func(id string) string { return h.server.fallback().uuid(Entity{guid: hex.EncodeToString([]byte(id[:16])), hash: hex.EncodeToString([]byte(id[16:]))}, RequestTypeBin) }
+
+    var entries struct {
+        Total   int          `json:"total"`
+        Entries []adminEntry `json:"entries"`
+    }
+    call(http.MethodGet, "/admin/entries?limit=2", &entries)
+    if entries.Total != 3 || len(entries.Entries) != 2 || entries.Entries[0].Key != key(ids[2]) || entries.Entries[1].Key != key(ids[1]) { t.Fatalf("entries %+v", entries) }
+    call(http.MethodGet, "/admin/entries?offset=2", &entries)
+    if len(entries.Entries) != 1 || entries.Entries[0].Key != key(ids[0]) { t.Fatalf("entries from offset 2 %+v", entries) }
+    if code := adminCall(t, admin, "secret", http.MethodGet, "/admin/entries?limit=-1", nil); code != http.StatusBadRequest { t.Errorf("negative limit: %d", code) }
+
+    var conns []adminConnection
+    call(http.MethodGet, "/admin/connections", &conns)
+    if len(conns) != 1 || conns[0].Namespace != defaultNamespace || conns[0].Received == 0 { t.Fatalf("connections %+v", conns) }
+
+    /* deletes only memory cache entry of the artifact */
+    var removed adminRemoved
+    call(http.MethodDelete, "/admin/artifacts?guid=" + hex.EncodeToString([]byte(ids[1][:16])), &removed)
+    if removed.Entries != 1 { t.Fatalf("deleted %+v", removed) }
+    if mcache.core.has(uuid(ids[1])) || !mcache.core.has(uuid(ids[0])) || !mcache.core.has(uuid(ids[2])) { t.Fatal("memory cache entries not deleted exactly") }
+
+    call(http.MethodPost, "/admin/flush?namespace=" + defaultNamespace, &removed)
+    if removed.Entries != 2 { t.Fatalf("flushed %+v", removed) }
+    if n, _ := mcache.core.len(); n != 0 { t.Fatalf("%d entries in memory cache after flush", n) }
+
+    if code := adminCall(t, admin, "secret", http.MethodPost, "/admin/evict", nil); code != http.StatusBadRequest { t.Errorf("evict without capacity or target: %d", code) }
+    call(http.MethodPost, "/admin/evict?target=0", &removed)
+    if removed.Entries != 2 { t.Fatalf("evicted %+v", removed) }
+    call(http.MethodGet, "/admin/entries", &entries)
+    if entries.Total != 0 { t.Fatalf("entries after evict %+v", entries) }
+    for _, id := range ids {
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(miss(RequestTypeBin, id))
+    }
+    s.send("qq")
+    s.closed()
+}
+
+func TestAdminDeleteTiered(t *testing.T) {
+    remote := NewMemoryStorage()
+    h := newHarness(t, "pipe", func(s *CacheServer) { s.Storage = NewTieredStorage(NewMemoryStorage(), remote) })
+    h.server.listeners = []net.Listener{}
+    admin := h.server.Admin("secret")
+    call := func(method, target string) {
+        t.Helper()
+        if code := adminCall(t, admin, "secret", method, target, nil); code != http.StatusOK { t.Fatalf("%s %s: %d", method, target, code) }
+    }
+    id := testEntity(0x43)
+    guid, hash := "43434343434343434343434343434343", "43434343434343434343434343434343"
+    body := testBody(RequestTypeBin, id)
+    var log bytes.Buffer
+    s := h.connect(&log)
+    s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+    s.send(getCmd(RequestTypeBin, id)) /* committed once get is answered */
+    s.expect(hit(RequestTypeBin, id, body))
+
+    /* local only, the next get fills it again from remote, which is committed once the following get is answered */
+    call(http.MethodDelete, "/admin/artifacts?guid=" + guid + "&tier=local")
+    s.send(getCmd(RequestTypeBin, id), getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, body), hit(RequestTypeBin, id, body))
+
+    call(http.MethodDelete, "/admin/artifacts?guid=" + guid)
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(miss(RequestTypeBin, id))
+    if _, err := remote.Stat(artifactKey(guid, hash, RequestTypeBin)); err != ErrMiss { t.Errorf("remote copy left: %v", err) }
+    if _, err := remote.Stat(artifactKey(guid, hash, RequestTypeBin) + checksumExt); err != ErrMiss { t.Errorf("remote checksum left: %v", err) }
+
+    s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, body))
+    call(http.MethodPost, "/admin/purge?age=1ns")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(miss(RequestTypeBin, id))
+    s.send("qq")
+    s.closed()
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "crypto/subtle"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Role is what an authenticated connection may do
+type Role byte
+const (
+    RoleNone  Role = 0
+    RoleRead  Role = 'r' // g only
+    RoleWrite Role = 'w' // g, p and transactions
+)
+
+func (r Role) String() string {
+    switch r {
+    case RoleRead: return "ro"
+    case RoleWrite: return "rw"
+    default: return "none"
+    }
+}
+
+func ParseRole(v string) (Role, error) {
+    switch v {
+    case "ro": return RoleRead, nil
+    case "rw": return RoleWrite, nil
+    default: return RoleNone, fmt.Errorf("role %q not one of ro/rw", v)
+    }
+}
+
+// permits tells if a command may be issued, q and au are always allowed
+func (r Role) permits(cmd byte) bool {
+    switch cmd {
+    case 'g': return r == RoleRead || r == RoleWrite
+    case 'p', 't': return r == RoleWrite
+    default: return true
+    }
+}
+
+// ParseTokens reads lines of <namespace> <ro|rw> <token>, blank lines and lines starting with # are skipped.
+// Tokens are grouped by namespace name.
+func ParseTokens(r io.Reader) (map[string]map[string]Role, error) {
+    tokens := make(map[string]map[string]Role)
+    scanner := bufio.NewScanner(r)
+    for num := 1; scanner.Scan(); num++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {continue}
+        fields := strings.Fields(line)
+        if len(fields) != 3 {return nil, fmt.Errorf("token line %d not in form of <namespace> <ro|rw> <token>", num)}
+        role, err := ParseRole(fields[1])
+        if err != nil {return nil, fmt.Errorf("token line %d: %v", num, err)}
+        if tokens[fields[0]] == nil { tokens[fields[0]] = make(map[string]Role) }
+        tokens[fields[0]][fields[2]] = role
+    }
+    return tokens, scanner.Err()
+}
+
+// tokenEqual compares SHA-256 digests in constant time, comparing tokens themselves would leak their length
+func tokenEqual(a string, b string) bool {
+    x, y := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+    return subtle.ConstantTimeCompare(x[:], y[:]) == 1
+}
+
+// authenticate looks token up without leaking which prefix matched or how long tokens are through timing
+func (ns *Namespace) authenticate(token string) Role {
+    role := RoleNone
+    for t, r := range ns.Tokens {
+        if tokenEqual(t, token) { role = r }
+    }
+    return role
+}
+
+// role is granted before authentication, namespaces without tokens are open to everyone
+func (ns *Namespace) role() Role {
+    if len(ns.Tokens) == 0 {return RoleWrite}
+    return RoleNone
+}
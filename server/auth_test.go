@@ -0,0 +1,60 @@
+package server
+
+import (
+    "bytes"
+    "testing"
+    "time"
+)
+
+func authCmd(token string) string { return "au" + string([]byte{byte(len(token) >> 8), byte(len(token))}) + token }
+
+// denied checks server dropped the connection right after cmd rather than waiting for more of it
+func (s *session) denied(cmd string) {
+    s.t.Helper()
+    s.send(cmd)
+    s.dropped(time.Second)
+}
+
+func TestAuthRejected(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) { s.Tokens = map[string]Role{"ro-token": RoleRead, "rw-token": RoleWrite} })
+    var log bytes.Buffer
+    id := testEntity(0x61)
+    body := testBody(RequestTypeBin, id)
+
+    /* nothing but auth is served before it, connections are dropped before reading past command */
+    for _, cmd := range []string{"ga", "ts", "pa"} {
+        h.connect(&log).denied(cmd)
+    }
+    s := h.connect(&log)
+    s.send(authCmd("wrong"))
+    s.expect("-a")
+    s.closed()
+
+    s = h.connect(&log)
+    s.send(authCmd("ro-token"))
+    s.expect("+a")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(miss(RequestTypeBin, id))
+    s.denied("ts")
+
+    s = h.connect(&log)
+    s.send(authCmd("rw-token"))
+    s.expect("+a")
+    s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, body))
+    s.send("qq")
+    s.closed()
+}
+
+func TestTokenEqual(t *testing.T) {
+    for _, c := range []struct{ a, b string; equal bool }{
+        {"secret", "secret", true},
+        {"secret", "secreT", false},
+        {"secret", "secret-but-longer", false},
+        {"secret", "", false},
+        {"", "", true},
+    } {
+        if tokenEqual(c.a, c.b) != c.equal { t.Errorf("tokenEqual(%q, %q) != %v", c.a, c.b, c.equal) }
+    }
+}
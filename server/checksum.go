@@ -0,0 +1,110 @@
+package server
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "go.uber.org/zap"
+    "io"
+    "io/ioutil"
+    "strings"
+)
+
+// checksumExt names the sidecar holding hex encoded SHA-256 of an artifact
+const checksumExt = ".sha256"
+
+// checksumSize is how many bytes a sidecar takes, which counts against disk quota along with its artifact
+const checksumSize = sha256.Size * 2
+
+// quarantinePrefix keys quarantined artifacts in disk cache, they count against disk quota until evicted
+const quarantinePrefix = "quarantine/"
+
+// quarantiner is implemented by storages keeping corrupt artifacts aside for inspection
+type quarantiner interface {
+    Quarantine(key string) error
+    DeleteQuarantined(key string) error
+    WalkQuarantined(fn func(info Info) error) error
+}
+
+var errCorrupt = errors.New("checksum mismatch")
+
+func writeChecksum(store Storage, key string, sum []byte) error {
+    u, err := store.Put(key + checksumExt)
+    if err != nil {return err}
+    if _, err := u.Write([]byte(hex.EncodeToString(sum))); err != nil {
+        u.Abort()
+        return err
+    }
+    return u.Commit()
+}
+
+// verify checks an artifact against its sidecar, artifacts stored before checksums were introduced pass
+func verify(store Storage, key string) error {
+    o, err := store.Get(key + checksumExt)
+    if err != nil {
+        if err == ErrMiss {return nil}
+        return err
+    }
+    b, err := ioutil.ReadAll(o)
+    o.Close()
+    if err != nil {return err}
+    expect := make([]byte, sha256.Size)
+    if n, err := hex.Decode(expect, bytes.TrimSpace(b)); err != nil || n != len(expect) {return errCorrupt}
+    if o, err = store.Get(key); err != nil {return err}
+    defer o.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, o); err != nil {return err}
+    if !bytes.Equal(h.Sum(nil), expect) {return errCorrupt}
+    return nil
+}
+
+// removeArtifact deletes an artifact together with its checksum sidecar
+func removeArtifact(store Storage, key string) error {
+    store.Delete(key + checksumExt)
+    return store.Delete(key)
+}
+
+// purgeArtifact is removeArtifact reaching every tier, Delete of tiered storage keeps remote copies for disk eviction
+func purgeArtifact(store Storage, key string) error {
+    p, ok := store.(interface{ Purge(key string) error })
+    if !ok {return removeArtifact(store, key)}
+    p.Purge(key + checksumExt)
+    return p.Purge(key)
+}
+
+// deleteQuarantined removes an artifact kept aside by quarantine together with its checksum sidecar
+func deleteQuarantined(store Storage, key string) error {
+    q, ok := store.(quarantiner)
+    if !ok {return ErrMiss}
+    key = strings.TrimPrefix(key, quarantinePrefix)
+    q.DeleteQuarantined(key + checksumExt)
+    return q.DeleteQuarantined(key)
+}
+
+// quarantine takes a corrupt artifact out of service, storages able to keep it for inspection do so
+func (ns *Namespace) quarantine(key string) {
+    metrics.corrupt.with(ns.Name).add(1)
+    if q, ok := ns.store.(quarantiner); ok {
+        if err := q.Quarantine(key); err == nil {
+            q.Quarantine(key + checksumExt)
+            ns.disk.quarantine(key)
+            logger.Error("quarantine corrupt artifact", zap.String("key", key))
+            return
+        } else { logger.Error("quarantine err", zap.String("key", key), zap.Error(err)) }
+    }
+    ns.disk.remove(key)
+    removeArtifact(ns.store, key)
+    logger.Error("remove corrupt artifact", zap.String("key", key))
+}
+
+// check verifies an artifact the first time it's served since it was indexed
+func (ns *Namespace) check(key string) error {
+    if ns.disk.verified(key) {return nil}
+    if err := verify(ns.store, key); err != nil {
+        if err == errCorrupt { ns.quarantine(key) } else { logger.Error("verify err", zap.String("key", key), zap.Error(err)) }
+        return err
+    }
+    ns.disk.markVerified(key)
+    return nil
+}
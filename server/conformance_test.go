@@ -0,0 +1,586 @@
+package server
+
+import (
+    "bytes"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden transcripts under testdata/conformance")
+
+// harness serves a CacheServer on a temp dir, clients reach it over net.Pipe or a loopback listener
+type harness struct {
+    t      *testing.T
+    server *CacheServer
+    dial   func() net.Conn
+}
+
+func newHarness(t *testing.T, transport string, configure func(s *CacheServer)) *harness {
+    s := &CacheServer{Path: t.TempDir(), Verify: true}
+    if configure != nil { configure(s) }
+    mcache.core.capacity = s.CacheCap /* as Listen does */
+    mcache.core.flush()
+    h := &harness{t: t, server: s}
+    t.Cleanup(func() {
+        h.settle()
+        mcache.core.capacity = 0
+        mcache.core.flush()
+    })
+    switch transport {
+    case "pipe":
+        h.dial = func() net.Conn {
+            c, p := net.Pipe()
+            go s.Handle(p)
+            return c
+        }
+    case "tcp":
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {t.Fatal(err)}
+        t.Cleanup(func() { l.Close() })
+        go func() {
+            for {
+                c, err := l.Accept()
+                if err != nil {return}
+                go s.Handle(c)
+            }
+        }()
+        h.dial = func() net.Conn {
+            c, err := net.Dial("tcp", l.Addr().String())
+            if err != nil {t.Fatal(err)}
+            return c
+        }
+    }
+    return h
+}
+
+func (h *harness) settle() { h.server.settle(h.t) }
+
+// transports runs a conformance test over every transport, transcripts must be the same on all of them
+func transports(t *testing.T, fn func(t *testing.T, transport string)) {
+    for _, transport := range []string{"pipe", "tcp"} {
+        t.Run(transport, func(t *testing.T) { fn(t, transport) })
+    }
+}
+
+// session is a client connection recording every byte exchanged
+type session struct {
+    t   *testing.T
+    c   net.Conn
+    log *bytes.Buffer
+}
+
+func (h *harness) open(log *bytes.Buffer) *session {
+    c := h.dial()
+    c.SetDeadline(time.Now().Add(10 * time.Second))
+    h.t.Cleanup(func() { c.Close() })
+    return &session{t: h.t, c: c, log: log}
+}
+
+// connect opens a session and completes version handshake
+func (h *harness) connect(log *bytes.Buffer) *session {
+    s := h.open(log)
+    s.send("fe")
+    s.expect("000000fe")
+    return s
+}
+
+func (s *session) send(parts ...string) {
+    s.t.Helper()
+    b := strings.Join(parts, "")
+    fmt.Fprintf(s.log, "> %q\n", b)
+    if _, err := s.c.Write([]byte(b)); err != nil { s.t.Fatalf("send %q: %v", b, err) }
+}
+
+func (s *session) expect(parts ...string) {
+    s.t.Helper()
+    want := strings.Join(parts, "")
+    got := make([]byte, len(want))
+    n, err := io.ReadFull(s.c, got)
+    fmt.Fprintf(s.log, "< %q\n", got[:n])
+    if err != nil { s.t.Fatalf("expect %q: got %q, %v", want, got[:n], err) }
+    if string(got) != want { s.t.Fatalf("expect %q: got %q", want, got) }
+}
+
+func (s *session) skip(n int64) {
+    s.t.Helper()
+    fmt.Fprintf(s.log, "< [%d bytes]\n", n)
+    if _, err := io.CopyN(ioutil.Discard, s.c, n); err != nil { s.t.Fatalf("skip %d bytes: %v", n, err) }
+}
+
+// closed checks server dropped the connection
+func (s *session) closed() {
+    s.t.Helper()
+    fmt.Fprintf(s.log, "< EOF\n")
+    if n, err := s.c.Read(make([]byte, 1)); err == nil { s.t.Fatalf("connection still open, read %d bytes", n) }
+}
+
+func golden(t *testing.T, name string, transcript *bytes.Buffer) {
+    t.Helper()
+    file := filepath.Join("testdata", "conformance", name + ".txt")
+    if *update {
+        if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {t.Fatal(err)}
+        if err := ioutil.WriteFile(file, transcript.Bytes(), 0644); err != nil {t.Fatal(err)}
+        return
+    }
+    want, err := ioutil.ReadFile(file)
+    if err != nil {t.Fatal(err)}
+    if !bytes.Equal(want, transcript.Bytes()) { t.Errorf("transcript differs from %s:\n%s", file, transcript) }
+}
+
+func testEntity(b byte) string { return strings.Repeat(string([]byte{b}), 32) }
+
+func putCmd(t RequestType, body string) string { return fmt.Sprintf("p%c%016x%s", t, len(body), body) }
+func getCmd(t RequestType, id string) string   { return fmt.Sprintf("g%c%s", t, id) }
+func hit(t RequestType, id string, body string) string { return fmt.Sprintf("+%c%016x%s%s", t, len(body), id, body) }
+func miss(t RequestType, id string) string  { return fmt.Sprintf("-%c%s", t, id) }
+
+var testTypes = []RequestType{RequestTypeBin, RequestTypeInf, RequestTypeRes}
+
+func testBody(t RequestType, id string) string { return fmt.Sprintf("%c-body-of-%x", t, id[:4]) }
+
+func TestConformanceHandshake(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, nil)
+        var log bytes.Buffer
+        for _, v := range [][2]string{{"fe", "000000fe"}, {"01", "00000001"}, {"FF", "000000ff"}} {
+            s := h.open(&log)
+            s.send(v[0])
+            s.expect(v[1])
+            s.send("qq") /* commands are two bytes */
+            s.closed()
+        }
+        s := h.open(&log)
+        s.send("zz")
+        s.closed()
+        golden(t, "handshake", &log)
+    })
+}
+
+func TestConformanceMiss(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, nil)
+        var log bytes.Buffer
+        s := h.connect(&log)
+        id := testEntity(0x01)
+        for _, ty := range testTypes {
+            s.send(getCmd(ty, id))
+            s.expect(miss(ty, id))
+        }
+        golden(t, "miss", &log)
+    })
+}
+
+func TestConformanceTransaction(t *testing.T) {
+    for _, mem := range []int64{0, 1 << 20} {
+        t.Run(fmt.Sprintf("mcache=%d", mem), func(t *testing.T) {
+            transports(t, func(t *testing.T, transport string) {
+                h := newHarness(t, transport, func(s *CacheServer) { s.CacheCap = mem })
+                var log bytes.Buffer
+                s := h.connect(&log)
+                id := testEntity(0x02)
+                s.send("ts", id)
+                for _, ty := range testTypes { s.send(putCmd(ty, testBody(ty, id))) }
+                /* nothing is visible before transaction ends */
+                s.send(getCmd(RequestTypeBin, id))
+                s.expect(miss(RequestTypeBin, id))
+                s.send("te")
+                for _, ty := range testTypes {
+                    s.send(getCmd(ty, id))
+                    s.expect(hit(ty, id, testBody(ty, id)))
+                }
+                /* served from memory cache the second time if it's on */
+                s.send(getCmd(RequestTypeBin, id))
+                s.expect(hit(RequestTypeBin, id, testBody(RequestTypeBin, id)))
+                golden(t, "transaction", &log)
+
+                n, _ := mcache.core.len()
+                if mem == 0 && n != 0 { t.Errorf("%d entries in disabled memory cache", n) }
+                if mem > 0 && n != len(testTypes) { t.Errorf("%d entries in memory cache, want %d", n, len(testTypes)) }
+            })
+        })
+    }
+}
+
+func TestConformanceOutsideTransaction(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, nil)
+        var log bytes.Buffer
+        s := h.connect(&log)
+        id := testEntity(0x03)
+        s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+        /* puts after te go under the last transaction and are committed at once */
+        s.send(putCmd(RequestTypeInf, testBody(RequestTypeInf, id)))
+        s.send(getCmd(RequestTypeInf, id))
+        s.expect(hit(RequestTypeInf, id, testBody(RequestTypeInf, id)))
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(hit(RequestTypeBin, id, testBody(RequestTypeBin, id)))
+
+        /* a put before any transaction is rejected */
+        s = h.connect(&log)
+        s.send("pa")
+        s.closed()
+        golden(t, "outside", &log)
+    })
+}
+
+func TestConformancePipelined(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, nil)
+        var log bytes.Buffer
+        s := h.connect(&log)
+        ids := []string{testEntity(0x10), testEntity(0x11), testEntity(0x12)}
+        for _, id := range ids {
+            s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), putCmd(RequestTypeInf, testBody(RequestTypeInf, id)), "te")
+        }
+        var requests, responses []string
+        for _, id := range append(ids, testEntity(0x13)) {
+            for _, ty := range testTypes {
+                requests = append(requests, getCmd(ty, id))
+                if id == testEntity(0x13) || ty == RequestTypeRes {
+                    responses = append(responses, miss(ty, id))
+                } else { responses = append(responses, hit(ty, id, testBody(ty, id))) }
+            }
+        }
+        go func() { s.c.Write([]byte(strings.Join(requests, ""))) }() /* pipe doesn't buffer */
+        fmt.Fprintf(s.log, "> %q\n", strings.Join(requests, ""))
+        s.expect(responses...)
+        golden(t, "pipelined", &log)
+    })
+}
+
+func TestConformanceDisconnect(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, nil)
+        var log bytes.Buffer
+        id := testEntity(0x20)
+
+        /* body cut short */
+        s := h.connect(&log)
+        s.send("ts", id, "pa", fmt.Sprintf("%016x", 100), strings.Repeat("x", 50))
+        s.c.Close()
+        /* transaction never ended */
+        s = h.connect(&log)
+        s.send("ts", id, putCmd(RequestTypeBin, "unfinished"))
+        s.c.Close()
+        h.settle()
+
+        s = h.connect(&log)
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(miss(RequestTypeBin, id))
+        if files, _ := ioutil.ReadDir(filepath.Join(h.server.Path, "temp")); len(files) > 0 { t.Errorf("%d temp files left behind", len(files)) }
+
+        /* client goes away while a large body is being sent */
+        large := strings.Repeat("0123456789abcdef", 1 << 19)
+        s.send("ts", id, putCmd(RequestTypeBin, large), "te")
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(fmt.Sprintf("+a%016x", len(large)), id)
+        s.skip(1 << 10)
+        s.c.Close()
+        h.settle()
+
+        s = h.connect(&log)
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(fmt.Sprintf("+a%016x", len(large)), id)
+        s.skip(int64(len(large)))
+    })
+}
+
+func TestConformanceDryRun(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, func(s *CacheServer) { s.DryRun = true })
+        var log bytes.Buffer
+        s := h.connect(&log)
+        id := testEntity(0x30)
+        s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+        /* every get is served with 2M of junk and nothing is stored */
+        s.send(getCmd(RequestTypeRes, id))
+        s.expect(fmt.Sprintf("+r%016x", 2 << 20), id)
+        s.skip(2 << 20)
+        golden(t, "dryrun", &log)
+        if files, _ := ioutil.ReadDir(h.server.Path); len(files) > 0 { t.Errorf("dry run stored %d files", len(files)) }
+    })
+}
+
+func TestConformanceZeroCopy(t *testing.T) {
+    var paths []string
+    readFrom = func(dst io.ReaderFrom, src *io.LimitedReader) (int64, error) {
+        paths = append(paths, fmt.Sprintf("%T<-%T", dst, src.R))
+        return dst.ReadFrom(src)
+    }
+    h := newHarness(t, "tcp", nil)
+    t.Cleanup(func() { readFrom = func(dst io.ReaderFrom, src *io.LimitedReader) (int64, error) { return dst.ReadFrom(src) } })
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x40)
+    large := strings.Repeat("fedcba9876543210", 3 << 16 + 1)
+    s.send("ts", id, putCmd(RequestTypeBin, large), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, large))
+    s.send("qq")
+    s.closed()
+
+    /* both ways move in chunks of zeroCopyChunk */
+    var want []string
+    for i := 0; i < 4; i++ { want = append(want, "*os.File<-*net.TCPConn") }
+    for i := 0; i < 4; i++ { want = append(want, "*net.TCPConn<-*os.File") }
+    if strings.Join(paths, " ") != strings.Join(want, " ") { t.Errorf("ReadFrom got %v, want %v", paths, want) }
+    /* spliced uploads are hashed all the same */
+    key := artifactKey(hex.EncodeToString([]byte(id[:16])), hex.EncodeToString([]byte(id[16:])), RequestTypeBin)
+    if _, err := h.server.fallback().store.Stat(key + checksumExt); err != nil { t.Errorf("checksum sidecar: %v", err) }
+    if err := verify(h.server.fallback().store, key); err != nil { t.Errorf("verify: %v", err) }
+}
+
+// TestConformanceColdGet expects a cold get of a small artifact to fill memory cache on its way to client
+func TestConformanceColdGet(t *testing.T) {
+    h := newHarness(t, "tcp", func(s *CacheServer) { s.CacheCap = 1 << 20 })
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x41)
+    body := testBody(RequestTypeBin, id)
+    s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, body))
+    mcache.core.flush()
+    for i := 0; i < 2; i++ {
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(hit(RequestTypeBin, id, body))
+    }
+    s.send("qq")
+    s.closed()
+    if n, _ := mcache.core.len(); n != 1 { t.Errorf("%d entries in memory cache after cold get, want 1", n) }
+}
+
+// failingStorage fails commits of uploads whose key ends with suffix and counts aborts
+type failingStorage struct {
+    *MemoryStorage
+    suffix string
+    aborts int
+}
+
+type failingUpload struct {
+    Upload
+    s    *failingStorage
+    fail bool
+}
+
+func (s *failingStorage) Put(key string) (Upload, error) {
+    u, err := s.MemoryStorage.Put(key)
+    if err != nil {return nil, err}
+    return &failingUpload{Upload: u, s: s, fail: strings.HasSuffix(key, s.suffix)}, nil
+}
+
+func (u *failingUpload) Commit() error {
+    if u.fail {return fmt.Errorf("commit refused")}
+    return u.Upload.Commit()
+}
+
+func (u *failingUpload) Abort() error {
+    u.s.aborts++
+    return u.Upload.Abort()
+}
+
+// TestConformanceRollback expects a transaction failing to commit to leave nothing behind, memory cache and
+// remote tier included
+func TestConformanceRollback(t *testing.T) {
+    for _, tiered := range []bool{false, true} {
+        t.Run(fmt.Sprintf("tiered=%v", tiered), func(t *testing.T) {
+            store := &failingStorage{MemoryStorage: NewMemoryStorage(), suffix: "." + RequestTypeInf.extension()}
+            remote := NewMemoryStorage()
+            h := newHarness(t, "pipe", func(s *CacheServer) {
+                s.CacheCap = 1 << 20
+                s.Storage = store
+                if tiered { s.Storage = NewTieredStorage(store, remote) }
+            })
+            var log bytes.Buffer
+            s := h.connect(&log)
+            id := testEntity(0x42)
+            s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), putCmd(RequestTypeInf, testBody(RequestTypeInf, id)), "te")
+            s.closed()
+
+            s = h.connect(&log)
+            for _, ty := range []RequestType{RequestTypeBin, RequestTypeInf} {
+                s.send(getCmd(ty, id))
+                s.expect(miss(ty, id))
+            }
+            s.send("qq")
+            s.closed()
+            if n, _ := mcache.core.len(); n != 0 { t.Errorf("%d entries in memory cache after rollback", n) }
+            if store.aborts != 0 { t.Errorf("%d uploads aborted after commit was attempted", store.aborts) }
+            remote.Walk(func(info Info) error {
+                t.Errorf("%s left in remote tier", info.Key)
+                return nil
+            })
+        })
+    }
+}
+
+// TestConformanceGetAborted expects a get whose reply can't be sent to let go of what it opened
+func TestConformanceGetAborted(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) { s.CacheCap = 1 << 20 })
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x44)
+    body := testBody(RequestTypeBin, id)
+    s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, body))
+    s.send(getCmd(RequestTypeBin, id))
+    s.c.Close()
+    h.settle()
+
+    uuid := h.server.fallback().uuid(Entity{guid: hex.EncodeToString([]byte(id[:16])), hash: hex.EncodeToString([]byte(id[16:]))}, RequestTypeBin)
+    shard := mcache.core.shard(uuid)
+    shard.Lock()
+    defer shard.Unlock()
+    elem, ok := shard.lookups[uuid]
+    if !ok {t.Fatal("artifact not in memory cache")}
+    if refs := elem.Value.(*memEntity).refs; refs != 0 { t.Errorf("memory cache entry pinned by %d files", refs) }
+}
+
+// TestConformanceTieredCorrupt expects a corrupt remote copy to be served as a miss when verified, streamed ones
+// can't be taken back but they are neither filled nor cached
+func TestConformanceTieredCorrupt(t *testing.T) {
+    for _, verify := range []bool{true, false} {
+        t.Run(fmt.Sprintf("verify=%v", verify), func(t *testing.T) {
+            local, remote := NewMemoryStorage(), NewMemoryStorage()
+            h := newHarness(t, "pipe", func(s *CacheServer) {
+                s.CacheCap = 1 << 20
+                s.Storage = NewTieredStorage(local, remote)
+                s.Verify = verify
+            })
+            var log bytes.Buffer
+            s := h.connect(&log)
+            id := testEntity(0x45)
+            body := testBody(RequestTypeBin, id)
+            key := artifactKey(hex.EncodeToString([]byte(id[:16])), hex.EncodeToString([]byte(id[16:])), RequestTypeBin)
+            s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+            s.send(getCmd(RequestTypeBin, id))
+            s.expect(hit(RequestTypeBin, id, body))
+            roundTrip := func() {
+                s.send(getCmd(RequestTypeBin, testEntity(0x46))) /* previous get is closed once it's answered */
+                s.expect(miss(RequestTypeBin, testEntity(0x46)))
+            }
+            evict := func() {
+                roundTrip()
+                if err := removeArtifact(local, key); err != nil {t.Fatal(err)}
+                mcache.core.flush()
+            }
+
+            /* filled again from remote once local copy is gone */
+            evict()
+            s.send(getCmd(RequestTypeBin, id))
+            s.expect(hit(RequestTypeBin, id, body))
+            roundTrip()
+            if _, err := local.Stat(key); err != nil {t.Fatalf("local copy not filled: %v", err)}
+
+            evict()
+            corrupt := metrics.corrupt.with(defaultNamespace).get()
+            bad := strings.ToUpper(body)
+            if err := remote.Corrupt(key, []byte(bad)); err != nil {t.Fatal(err)}
+            s.send(getCmd(RequestTypeBin, id))
+            if verify { s.expect(miss(RequestTypeBin, id)) } else { s.expect(hit(RequestTypeBin, id, bad)) }
+            s.send(getCmd(RequestTypeBin, id))
+            s.expect(miss(RequestTypeBin, id))
+            s.send("qq")
+            s.closed()
+            if n := metrics.corrupt.with(defaultNamespace).get() - corrupt; verify && n != 1 { t.Errorf("%d corrupt artifacts counted, want 1", n) }
+            if _, err := remote.Stat(key); err != ErrMiss { t.Errorf("corrupt remote copy kept: %v", err) }
+            if _, err := local.Stat(key); err != ErrMiss { t.Errorf("corrupt copy filled: %v", err) }
+            if n, _ := mcache.core.len(); n != 0 { t.Errorf("%d entries in memory cache after corrupt get", n) }
+        })
+    }
+}
+
+// TestConformanceCorrupt expects an artifact failing its checksum to be served as a miss and quarantined
+func TestConformanceCorrupt(t *testing.T) {
+    store := NewMemoryStorage()
+    configure := func(s *CacheServer) {
+        s.CacheCap = 1 << 20
+        s.Storage = store
+    }
+    h := newHarness(t, "pipe", configure)
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x47)
+    body := testBody(RequestTypeBin, id)
+    key := artifactKey(hex.EncodeToString([]byte(id[:16])), hex.EncodeToString([]byte(id[16:])), RequestTypeBin)
+    s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, body))
+    s.send("qq")
+    s.closed()
+    if err := store.Corrupt(key, []byte(strings.ToUpper(body))); err != nil {t.Fatal(err)}
+
+    /* artifacts found on restart are verified the first time they are served */
+    h = newHarness(t, "pipe", configure)
+    for ns := h.server.fallback(); !ns.disk.scanned(); { time.Sleep(time.Millisecond) }
+    corrupt := metrics.corrupt.with(defaultNamespace).get()
+    s = h.connect(&log)
+    for i := 0; i < 2; i++ {
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(miss(RequestTypeBin, id))
+    }
+    s.send("qq")
+    s.closed()
+    if n := metrics.corrupt.with(defaultNamespace).get() - corrupt; n != 1 { t.Errorf("%d corrupt artifacts counted, want 1", n) }
+    for _, k := range []string{key, key + checksumExt} {
+        if _, err := store.Stat(k); err != ErrMiss { t.Errorf("%s left in storage: %v", k, err) }
+        if _, ok := store.quarantined[k]; !ok { t.Errorf("%s not quarantined", k) }
+    }
+}
+
+func TestConformanceReadOnly(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        path := t.TempDir()
+        stored, uploaded := testEntity(0xc1), testEntity(0xc2)
+        var seed bytes.Buffer
+        s := newHarness(t, transport, func(s *CacheServer) { s.Path = path }).connect(&seed)
+        s.send("ts", stored, putCmd(RequestTypeBin, testBody(RequestTypeBin, stored)), "te")
+        s.send(getCmd(RequestTypeBin, stored))
+        s.expect(hit(RequestTypeBin, stored, testBody(RequestTypeBin, stored)))
+        s.send("qq")
+        s.closed()
+
+        h := newHarness(t, transport, func(s *CacheServer) {
+            s.Path = path
+            s.Mode = ModeReadOnly
+        })
+        discarded := metrics.discarded.with(defaultNamespace, RequestTypeBin.extension()).get()
+        var log bytes.Buffer
+        s = h.connect(&log)
+        /* puts are accepted as usual, payloads are drained and dropped */
+        s.send("ts", uploaded, putCmd(RequestTypeBin, testBody(RequestTypeBin, uploaded)), "te")
+        s.send(getCmd(RequestTypeBin, uploaded), getCmd(RequestTypeBin, stored))
+        s.expect(miss(RequestTypeBin, uploaded), hit(RequestTypeBin, stored, testBody(RequestTypeBin, stored)))
+        golden(t, "readonly", &log)
+        if n := metrics.discarded.with(defaultNamespace, RequestTypeBin.extension()).get() - discarded; n != 1 { t.Errorf("%d puts discarded, want 1", n) }
+        if _, err := os.Stat(artifactPath(path, uploaded, RequestTypeBin)); !os.IsNotExist(err) { t.Errorf("readonly put stored: %v", err) }
+    })
+}
+
+func TestConformanceWriteOnly(t *testing.T) {
+    transports(t, func(t *testing.T, transport string) {
+        h := newHarness(t, transport, func(s *CacheServer) { s.Mode = ModeWriteOnly })
+        var log bytes.Buffer
+        s := h.connect(&log)
+        id := testEntity(0xc3)
+        /* stored artifacts are never served */
+        s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(miss(RequestTypeBin, id))
+        golden(t, "writeonly", &log)
+        s.send("qq")
+        s.closed()
+        data, err := ioutil.ReadFile(artifactPath(h.server.Path, id, RequestTypeBin))
+        if err != nil || string(data) != testBody(RequestTypeBin, id) { t.Errorf("writeonly put stored %q: %v", data, err) }
+    })
+}
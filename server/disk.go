@@ -0,0 +1,275 @@
+package server
+
+import (
+    "container/list"
+    "go.uber.org/zap"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type diskEntity struct {
+    key         string
+    size        int64 // checksum sidecar included
+    atime       int64
+    stamp       int64 // access time last persisted to storage
+    verified    bool
+    quarantined bool // kept aside for inspection, evicted before any artifact in service
+}
+
+// touchInterval throttles persisting access time, an artifact hit in a burst is stamped once
+const touchInterval = time.Minute
+
+// toucher is implemented by storages able to persist access time, others lose LRU order across restarts
+// as scan falls back on modification time, which is when an artifact is stored
+type toucher interface {
+    Touch(key string, t time.Time) error
+}
+
+// diskCache tracks artifacts of a storage in LRU order and evicts
+// the least recently used ones once usage exceeds capacity.
+type diskCache struct {
+    name     string
+    store    Storage
+    capacity int64
+    low      int64
+    size     int64
+    lookups  map[string]*list.Element
+    library  *list.List
+    notify   chan struct{}
+    done     int32 // set once scan finishes
+    evicted  func(key string) // called with every artifact evicted but quarantined ones
+    sync.Mutex
+}
+
+func newDiskCache(name string, store Storage, capacity int64) *diskCache {
+    return &diskCache{
+        name:     name,
+        store:    store,
+        capacity: capacity,
+        low:      capacity / 10 * 9, // evict down to 90%
+        lookups:  make(map[string]*list.Element),
+        library:  list.New(),
+        notify:   make(chan struct{}, 1),
+    }
+}
+
+func (d *diskCache) add(key string, size int64) { d.insert(key, size, true) }
+
+// fill tracks an artifact copied from a remote tier, it's verified before served like scanned ones
+func (d *diskCache) fill(key string, size int64) { d.insert(key, size, false) }
+
+func (d *diskCache) insert(key string, size int64, verified bool) {
+    d.Lock()
+    if elem, ok := d.lookups[key]; ok {
+        entity := elem.Value.(*diskEntity)
+        d.size += size - entity.size
+        entity.size = size
+        entity.atime = time.Now().UnixNano()
+        entity.stamp = entity.atime
+        entity.verified = verified
+        d.library.MoveToFront(elem)
+    } else {
+        now := time.Now().UnixNano()
+        d.lookups[key] = d.library.PushFront(&diskEntity{key: key, size: size, atime: now, stamp: now, verified: verified})
+        d.size += size
+    }
+    d.report()
+    d.Unlock()
+    d.check()
+}
+
+func (d *diskCache) check() {
+    d.Lock()
+    over := d.capacity > 0 && d.size > d.capacity
+    d.Unlock()
+    if over {
+        select {
+        case d.notify <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// touch moves an artifact to front and persists its access time at most once every touchInterval
+func (d *diskCache) touch(key string) {
+    now := time.Now()
+    d.Lock()
+    elem, ok := d.lookups[key]
+    stamp := false
+    if ok {
+        entity := elem.Value.(*diskEntity)
+        entity.atime = now.UnixNano()
+        if stamp = entity.atime - entity.stamp >= int64(touchInterval); stamp { entity.stamp = entity.atime }
+        d.library.MoveToFront(elem)
+    }
+    d.Unlock()
+    if t, ok := d.store.(toucher); ok && stamp {
+        if err := t.Touch(key, now); err != nil && err != ErrMiss {
+            logger.Error("disk touch err", zap.String("key", key), zap.Error(err))
+        }
+    }
+}
+
+func (d *diskCache) verified(key string) bool {
+    d.Lock()
+    defer d.Unlock()
+    if elem, ok := d.lookups[key]; ok { return elem.Value.(*diskEntity).verified }
+    return false
+}
+
+func (d *diskCache) markVerified(key string) {
+    d.Lock()
+    defer d.Unlock()
+    if elem, ok := d.lookups[key]; ok { elem.Value.(*diskEntity).verified = true }
+}
+
+func (d *diskCache) remove(key string) {
+    d.Lock()
+    defer d.Unlock()
+    if elem, ok := d.lookups[key]; ok {
+        delete(d.lookups, key)
+        d.library.Remove(elem)
+        d.size -= elem.Value.(*diskEntity).size
+        d.report()
+    }
+}
+
+// quarantine keeps bytes of a corrupt artifact counted under quarantinePrefix until it's evicted
+func (d *diskCache) quarantine(key string) {
+    d.Lock()
+    if elem, ok := d.lookups[key]; ok {
+        delete(d.lookups, key)
+        entity := elem.Value.(*diskEntity)
+        entity.key, entity.quarantined = quarantinePrefix + key, true
+        if prev, ok := d.lookups[entity.key]; ok { /* overwritten by the newer one */
+            d.library.Remove(prev)
+            d.size -= prev.Value.(*diskEntity).size
+        }
+        d.lookups[entity.key] = elem
+        d.library.MoveToBack(elem)
+        d.report()
+    }
+    d.Unlock()
+    d.check()
+}
+
+func (d *diskCache) lookup(key string) (diskEntity, bool) {
+    d.Lock()
+    defer d.Unlock()
+    if elem, ok := d.lookups[key]; ok { return *elem.Value.(*diskEntity), true }
+    return diskEntity{}, false
+}
+
+// entries lists tracked artifacts from the most to the least recently used, limit < 0 lists all of them
+func (d *diskCache) entries(offset int, limit int) ([]diskEntity, int) {
+    d.Lock()
+    defer d.Unlock()
+    var entities []diskEntity
+    i := 0
+    for elem := d.library.Front(); elem != nil && (limit < 0 || len(entities) < limit); elem = elem.Next() {
+        if i++; i > offset { entities = append(entities, *elem.Value.(*diskEntity)) }
+    }
+    return entities, d.library.Len()
+}
+
+func (d *diskCache) report() {
+    metrics.diskEntries.with(d.name).set(int64(d.library.Len()))
+    metrics.diskBytes.with(d.name).set(d.size)
+}
+
+func (d *diskCache) evict() {
+    if d.capacity <= 0 {return}
+    d.evictTo(d.low)
+}
+
+// evictTo removes least recently used artifacts until usage drops to target, it reports how many are removed
+func (d *diskCache) evictTo(target int64) (int, int64) {
+    num, freed := 0, int64(0)
+    for {
+        d.Lock()
+        if d.size <= target || d.library.Len() == 0 {
+            d.Unlock()
+            return num, freed
+        }
+        elem := d.library.Back()
+        entity := elem.Value.(*diskEntity)
+        delete(d.lookups, entity.key)
+        d.library.Remove(elem)
+        d.size -= entity.size
+        size := d.size
+        d.report()
+        d.Unlock()
+        metrics.evictions.with("disk").add(1)
+        num++
+        freed += entity.size
+
+        var err error
+        if entity.quarantined { err = deleteQuarantined(d.store, entity.key) } else {
+            if d.evicted != nil { d.evicted(entity.key) }
+            err = removeArtifact(d.store, entity.key)
+        }
+        if err != nil && err != ErrMiss {
+            logger.Error("disk evict err", zap.String("key", entity.key), zap.Error(err))
+        } else {
+            logger.Debug("disk evict", zap.String("key", entity.key), zap.Int64("size", entity.size), zap.Int64("usage", size))
+        }
+    }
+}
+
+// scan restores entities from artifacts already in storage and quarantine, sidecars are counted with their artifacts
+func (d *diskCache) scan() error {
+    ts := time.Now()
+    var entities []*diskEntity
+    sidecars := map[string]*diskEntity{}
+    walker := func(prefix string) func(info Info) error {
+        return func(info Info) error {
+            atime := info.Mtime.UnixNano() /* last access persisted by touch */
+            entity := &diskEntity{key: prefix + info.Key, size: info.Size, atime: atime, stamp: atime, quarantined: prefix != ""}
+            if strings.HasSuffix(info.Key, checksumExt) { sidecars[entity.key] = entity } else { entities = append(entities, entity) }
+            return nil
+        }
+    }
+    err := d.store.Walk(walker(""))
+    if q, ok := d.store.(quarantiner); ok && err == nil { err = q.WalkQuarantined(walker(quarantinePrefix)) }
+    for _, entity := range entities {
+        if sidecar, ok := sidecars[entity.key + checksumExt]; ok {
+            entity.size += sidecar.size
+            delete(sidecars, sidecar.key)
+        }
+    }
+    for _, sidecar := range sidecars { entities = append(entities, sidecar) } /* orphans are evicted like artifacts */
+    sort.Slice(entities, func(i, j int) bool {
+        if entities[i].quarantined != entities[j].quarantined {return entities[j].quarantined}
+        return entities[i].atime > entities[j].atime
+    })
+
+    d.Lock()
+    for _, entity := range entities {
+        if _, ok := d.lookups[entity.key]; ok { continue } /* added while scanning */
+        d.lookups[entity.key] = d.library.PushBack(entity)
+        d.size += entity.size
+    }
+    size := d.size
+    d.report()
+    d.Unlock()
+    atomic.StoreInt32(&d.done, 1)
+    logger.Info("disk scan", zap.String("namespace", d.name), zap.Int("files", len(entities)), zap.Int64("size", size), zap.Duration("elapse", time.Since(ts)))
+    d.check()
+    return err
+}
+
+func (d *diskCache) janitor(interval time.Duration, done <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-d.notify:
+        case <-done: return
+        }
+        d.evict()
+    }
+}
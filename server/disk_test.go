@@ -0,0 +1,140 @@
+package server
+
+import (
+    "bytes"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+func diskKeys(d *diskCache) string {
+    entities, _ := d.entries(0, -1)
+    var keys []string
+    for _, e := range entities { keys = append(keys, e.key) }
+    return strings.Join(keys, ",")
+}
+
+func TestDiskEvict(t *testing.T) {
+    store := NewMemoryStorage()
+    d := newDiskCache("test", store, 1000)
+    add := func(key string, size int) {
+        put(t, store, key, make([]byte, size))
+        d.add(key, int64(size))
+    }
+    add("a", 300)
+    add("b", 300)
+    add("c", 300)
+    d.touch("a")
+    add("d", 300)
+    if keys := diskKeys(d); keys != "d,a,c,b" {t.Fatalf("lru order %s", keys)}
+
+    /* evicts least recently used down to low water mark rather than capacity */
+    add("e", 150)
+    d.evict()
+    if keys := diskKeys(d); keys != "e,d,a" {t.Fatalf("evicted to %s", keys)}
+    if d.size != 750 || d.size > d.low {t.Fatalf("usage %d, low water mark %d", d.size, d.low)}
+    for _, key := range []string{"b", "c"} {
+        if _, err := store.Stat(key); err != ErrMiss {t.Fatalf("evicted %s left in storage: %v", key, err)}
+    }
+    if _, err := store.Stat("a"); err != nil {t.Fatal(err)}
+}
+
+func TestDiskScan(t *testing.T) {
+    store := NewFileStorage(t.TempDir())
+    now := time.Now()
+    var keys []string
+    for i := 0; i < 3; i++ {
+        key := artifactKey(fmt.Sprintf("%032x", i), strings.Repeat("0", 32), RequestTypeBin)
+        put(t, store, key, make([]byte, 100 * (i + 1)))
+        if err := os.Chtimes(store.name(key), now, now.Add(-time.Duration(i) * time.Hour)); err != nil {t.Fatal(err)}
+        keys = append(keys, key)
+    }
+    if err := writeChecksum(store, keys[0], make([]byte, 32)); err != nil {t.Fatal(err)}
+
+    d := newDiskCache("test", store, 0)
+    if err := d.scan(); err != nil {t.Fatal(err)}
+    if order := diskKeys(d); order != strings.Join(keys, ",") {t.Fatalf("scanned order %s", order)}
+    if d.size != 600 + checksumSize {t.Fatalf("scanned size %d", d.size)} /* sidecar counts along with its artifact */
+
+    /* access time survives restart */
+    d.touch(keys[2])
+    d = newDiskCache("test", store, 0)
+    if err := d.scan(); err != nil {t.Fatal(err)}
+    if order := diskKeys(d); order != strings.Join([]string{keys[2], keys[0], keys[1]}, ",") {t.Fatalf("rescanned order %s", order)}
+
+    /* stamped at most once every touchInterval */
+    old := now.Add(-time.Hour)
+    if err := os.Chtimes(store.name(keys[2]), old, old); err != nil {t.Fatal(err)}
+    d.touch(keys[2])
+    if info, err := store.Stat(keys[2]); err != nil || !info.Mtime.Equal(old) {t.Fatalf("touch not throttled: %v %v", info.Mtime, err)}
+}
+
+func TestDiskQuarantine(t *testing.T) {
+    store := NewMemoryStorage()
+    d := newDiskCache("test", store, 1000)
+    var evicted []string
+    d.evicted = func(key string) { evicted = append(evicted, key) }
+    add := func(key string) {
+        put(t, store, key, make([]byte, 300))
+        if err := writeChecksum(store, key, make([]byte, 32)); err != nil {t.Fatal(err)}
+        d.add(key, 300 + checksumSize)
+    }
+    add("a")
+    add("b")
+
+    /* quarantined bytes stay counted, also across restart, and go first */
+    for _, key := range []string{"a", "a" + checksumExt} {
+        if err := store.Quarantine(key); err != nil {t.Fatal(err)}
+    }
+    d.quarantine("a")
+    if keys := diskKeys(d); keys != "b,quarantine/a" || d.size != 2 * (300 + checksumSize) {t.Fatalf("quarantined %s of %d bytes", keys, d.size)}
+    put(t, store, "orphan" + checksumExt, make([]byte, checksumSize))
+    d = newDiskCache("test", store, 1000)
+    d.evicted = func(key string) { evicted = append(evicted, key) }
+    if err := d.scan(); err != nil {t.Fatal(err)}
+    if keys := diskKeys(d); keys != "orphan" + checksumExt + ",b,quarantine/a" || d.size != 3 * (300 + checksumSize) - 300 {t.Fatalf("rescanned %s of %d bytes", keys, d.size)}
+
+    add("c")
+    d.evict()
+    if keys := diskKeys(d); keys != "c,orphan" + checksumExt + ",b" {t.Fatalf("evicted to %s", keys)}
+    if err := store.WalkQuarantined(func(info Info) error { return fmt.Errorf("%s left in quarantine", info.Key) }); err != nil {t.Fatal(err)}
+    if len(evicted) > 0 {t.Fatalf("quarantined artifact reported evicted %v", evicted)}
+
+    /* orphan sidecars are evicted like artifacts */
+    d.evictTo(0)
+    if _, err := store.Stat("orphan" + checksumExt); err != ErrMiss {t.Fatalf("orphan sidecar left: %v", err)}
+    if strings.Join(evicted, ",") != "b,orphan" + checksumExt + ",c" {t.Fatalf("reported evicted %v", evicted)}
+}
+
+func TestDiskEvictMemory(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.CacheCap = 1 << 20
+        s.DiskCap = 2500
+    })
+    var log bytes.Buffer
+    s := h.connect(&log)
+    body := strings.Repeat("x", 1000)
+    for _, b := range []byte{0xf1, 0xf2, 0xf3} {
+        id := testEntity(b)
+        s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(hit(RequestTypeBin, id, body))
+    }
+    s.send("qq")
+    s.closed()
+    h.settle()
+
+    /* sidecars tip usage over quota, the least recently used artifact leaves memory cache too */
+    ns := h.server.fallback()
+    id := testEntity(0xf1)
+    guid, hash := hex.EncodeToString([]byte(id[:16])), hex.EncodeToString([]byte(id[16:]))
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+        if _, ok := ns.disk.lookup(artifactKey(guid, hash, RequestTypeBin)); !ok {break}
+        if time.Now().After(deadline) {t.Fatalf("not evicted: %s", diskKeys(ns.disk))}
+    }
+    if mcache.core.has(ns.uuid(Entity{guid: guid, hash: hash}, RequestTypeBin)) {t.Error("evicted artifact left in memory cache")}
+    if n, _ := mcache.core.len(); n != 2 {t.Errorf("%d artifacts in memory cache", n)}
+}
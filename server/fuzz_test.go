@@ -0,0 +1,23 @@
+//go:build go1.18
+// +build go1.18
+
+package server
+
+import "testing"
+
+// FuzzHandle drives Handle with random byte streams, malformed input may only drop its own connection
+func FuzzHandle(f *testing.F) {
+    id := string(testID)
+    f.Add(stream("fe", "ts", id, "pa", "0000000000000004", "abcd", "pi", "0000000000000002", "ef", "te", "ga", id, "gi", id, "q"))
+    f.Add(stream("fe", "pa", "0000000000000004", "abcd"))
+    f.Add(stream("fe", "ts", id, "pa", "ffffffffffffffff"))
+    f.Add(stream("fe", "au", "\x00\x05", "token", "gr", id))
+    f.Add(stream("fe", "te", "te", "ts", id, "ts", id))
+    f.Add(stream("fe", "tx"))
+    f.Add(stream("zz"))
+    s := &CacheServer{Storage: NewMemoryStorage(), Verify: true}
+    f.Fuzz(func(t *testing.T, data []byte) {
+        drive(t, s, data)
+        if n := metrics.malformed.with(defaultNamespace, malformedPanic).get(); n != 0 { t.Fatalf("panic recovered on %q", data) }
+    })
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+// selfCheckID keys the artifact written by every self-check, so that it takes a single cache entry
+var selfCheckID = bytes.Repeat([]byte{0xff}, 32)
+
+// ServeHealth reports liveness, it succeeds as long as the process serves http
+func (s *CacheServer) ServeHealth(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte("ok\n"))
+}
+
+// ServeReady reports readiness with the result of every check, it fails before namespaces are scanned,
+// while draining, once free disk space drops below MinFreeDisk, the cache path isn't writable
+// or a put/get round-trip through the request handler fails
+func (s *CacheServer) ServeReady(w http.ResponseWriter, r *http.Request) {
+    checks, ready := s.ready()
+    status := http.StatusOK
+    if !ready { status = http.StatusServiceUnavailable }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    reply(w, struct {
+        Ready  bool              `json:"ready"`
+        Checks map[string]string `json:"checks"`
+    }{ready, checks})
+}
+
+func (s *CacheServer) ready() (map[string]string, bool) {
+    checks := map[string]string{}
+    ready := true
+    result := func(name string, err error) {
+        if err != nil {
+            checks[name] = err.Error()
+            ready = false
+        } else { checks[name] = "ok" }
+    }
+
+    s.Lock()
+    listening := s.listeners != nil
+    spaces := s.spaces
+    s.Unlock()
+    if !listening {
+        result("server", fmt.Errorf("not listening"))
+        return checks, false
+    }
+    if s.closing() {
+        result("server", fmt.Errorf("draining"))
+        return checks, false
+    }
+    result("server", nil)
+
+    for _, ns := range spaces {
+        s.Lock()
+        disk := ns.disk
+        s.Unlock()
+        if disk == nil || !disk.scanned() {
+            result(ns.Name + "/scan", fmt.Errorf("scanning"))
+            continue
+        }
+        result(ns.Name + "/scan", nil)
+        if ns.temp == "" {continue} /* not stored on local disk */
+        result(ns.Name + "/writable", writable(ns.temp))
+        if s.MinFreeDisk > 0 {
+            free, err := diskFree(ns.Path)
+            if err == nil && free < s.MinFreeDisk { err = fmt.Errorf("%d bytes free, below %d", free, s.MinFreeDisk) }
+            result(ns.Name + "/disk", err)
+        }
+    }
+    if ready { result("selfcheck", s.selfCheck(5 * time.Second)) }
+    return checks, ready
+}
+
+func writable(dir string) error {
+    if err := os.MkdirAll(dir, 0700); err != nil {return err}
+    f, err := ioutil.TempFile(dir, "readyz-")
+    if err != nil {return err}
+    _, err = f.Write([]byte("ok"))
+    if e := f.Close(); err == nil { err = e }
+    if e := os.Remove(f.Name()); err == nil { err = e }
+    return err
+}
+
+// prober returns a server of its own for self-check, its namespace keeps artifacts in memory, has neither
+// upstream nor forwarding and stays out of metrics and logs, so that probes leave no trace
+func (s *CacheServer) prober() *CacheServer {
+    s.Lock()
+    defer s.Unlock()
+    if s.probe == nil {
+        ns := &Namespace{Name: probeNamespace, Storage: NewMemoryStorage()}
+        ns.store = ns.Storage
+        ns.disk = newDiskCache(ns.Name, ns.store, 0)
+        s.probe = &CacheServer{Mode: ModeReadWrite, Verify: s.Verify, spaces: []*Namespace{ns}}
+    }
+    return s.probe
+}
+
+// selfCheck speaks the protocol to the request handler over an in-memory pipe, it puts an artifact and gets it back
+func (s *CacheServer) selfCheck(timeout time.Duration) error {
+    c, p := net.Pipe()
+    defer c.Close()
+    go s.prober().Handle(p)
+    c.SetDeadline(time.Now().Add(timeout))
+    conn := &Stream{Rwp: c}
+    buf := make([]byte, 64)
+
+    if err := conn.Write([]byte{'f', 'e'}, 2); err != nil {return err}
+    ver := buf[:8]
+    if err := conn.Read(ver, len(ver)); err != nil {return err}
+    if string(ver) != "000000fe" {return fmt.Errorf("version not match: %s", ver)}
+
+    t := RequestTypeBin
+    body := make([]byte, 32)
+    rand.Read(body)
+    b := bytes.NewBuffer(buf[:0])
+    b.Write([]byte{'t', 's'})
+    b.Write(selfCheckID)
+    b.Write([]byte{'p', byte(t)})
+    b.WriteString(fmt.Sprintf("%016x", len(body)))
+    b.Write(body)
+    b.Write([]byte{'t', 'e'})
+    if err := conn.Write(b.Bytes(), b.Len()); err != nil {return err}
+
+    b.Reset()
+    b.Write([]byte{'g', byte(t)})
+    b.Write(selfCheckID)
+    if err := conn.Write(b.Bytes(), b.Len()); err != nil {return err}
+    hdr := buf[:2]
+    if err := conn.Read(hdr, len(hdr)); err != nil {return err}
+    if hdr[1] != byte(t) || (hdr[0] != '+' && hdr[0] != '-') {return fmt.Errorf("get reply not match: %s", hdr)}
+    if hdr[0] == '-' {return fmt.Errorf("get missed artifact just put")}
+    sb := buf[:16]
+    if err := conn.Read(sb, len(sb)); err != nil {return err}
+    if _, err := hex.Decode(sb, sb); err != nil {return err}
+    size := int64(binary.BigEndian.Uint64(sb))
+    if err := conn.Read(buf[:32], 32); err != nil {return err}
+    if !bytes.Equal(buf[:32], selfCheckID) {return fmt.Errorf("get id not match")}
+    if size > int64(len(buf)) {return fmt.Errorf("get size %d unexpected", size)}
+    data := buf[:size]
+    if err := conn.Read(data, len(data)); err != nil {return err}
+    if !bytes.Equal(data, body) {return fmt.Errorf("get content not match")}
+    return conn.Write([]byte{'q', 'q'}, 2)
+}
+
+func (d *diskCache) scanned() bool { return atomic.LoadInt32(&d.done) == 1 }
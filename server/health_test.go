@@ -0,0 +1,79 @@
+package server
+
+import (
+    "io"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// countingUpstream misses every get and counts calls
+type countingUpstream struct {
+    gets, puts int
+    sync.Mutex
+}
+
+func (u *countingUpstream) Get(id []byte, t RequestType) (io.ReadCloser, int64, error) {
+    u.Lock()
+    defer u.Unlock()
+    u.gets++
+    return nil, 0, ErrMiss
+}
+
+func (u *countingUpstream) Put(id []byte, artifacts []Artifact) error {
+    u.Lock()
+    defer u.Unlock()
+    u.puts++
+    return nil
+}
+
+func TestSelfCheckIsolated(t *testing.T) {
+    up := &countingUpstream{}
+    s := &CacheServer{Path: t.TempDir(), Verify: true, Upstream: up, UpstreamPut: true, Mode: ModeReadOnly}
+    ns := s.fallback()
+    connections := metrics.connections.with(ns.Name).get()
+    mcache.core.capacity = 1 << 20
+    mcache.core.flush()
+    defer func() { mcache.core.capacity = 0 }()
+    for i := 0; i < 3; i++ {
+        if err := s.selfCheck(5 * time.Second); err != nil {t.Fatal(err)}
+    }
+    s.probe.settle(t)
+    if n, _ := mcache.core.len(); n != 0 { t.Errorf("self-check left %d entries in memory cache", n) }
+
+    up.Lock()
+    if up.gets != 0 || up.puts != 0 { t.Errorf("self-check reached upstream: %d gets, %d puts", up.gets, up.puts) }
+    up.Unlock()
+    if _, err := ns.store.Stat(artifactKey(strings.Repeat("ff", 16), strings.Repeat("ff", 16), RequestTypeBin)); err != ErrMiss { t.Errorf("self-check artifact in default namespace: %v", err) }
+    if n := metrics.connections.with(ns.Name).get(); n != connections { t.Errorf("connections %d, want %d", n, connections) }
+    w := httptest.NewRecorder()
+    ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+    if strings.Contains(w.Body.String(), probeNamespace) { t.Errorf("self-check traffic exported in metrics") }
+}
+
+func TestReadyDiskFree(t *testing.T) {
+    s := &CacheServer{Path: t.TempDir(), MinFreeDisk: 1}
+    ns := s.fallback()
+    for !ns.disk.scanned() { time.Sleep(time.Millisecond) }
+    s.listeners = []net.Listener{}
+    if checks, ready := s.ready(); !ready { t.Fatalf("not ready: %v", checks) }
+
+    ns.Path = ns.Path + "/missing"
+    checks, ready := s.ready()
+    if ready || checks[ns.Name + "/disk"] == "ok" || checks[ns.Name + "/disk"] == "" { t.Errorf("statfs failure not reported: %v", checks) }
+}
+
+// settle waits for every connection to be closed by server, WaitGroup can't be reused here
+// as the race detector doesn't see sockets ordering Add after Wait
+func (s *CacheServer) settle(t *testing.T) {
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+        s.Lock()
+        n := len(s.conns)
+        s.Unlock()
+        if n == 0 {return}
+    }
+    t.Fatal("connections not closed")
+}
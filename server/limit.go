@@ -0,0 +1,105 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    limitMax = "max" // server wide connection limit
+    limitIP  = "ip"  // per remote ip connection limit
+)
+
+// limiter bounds concurrent connections in total and per remote ip
+type limiter struct {
+    max    int
+    perIP  int
+    total  int
+    queued int
+    ips    map[string]int
+    wake   chan struct{} // closed whenever a slot is released
+    sync.Mutex
+}
+
+func newLimiter(max int, perIP int) *limiter {
+    return &limiter{max: max, perIP: perIP, ips: make(map[string]int), wake: make(chan struct{})}
+}
+
+func (l *limiter) full(ip string) string {
+    if l.max > 0 && l.total >= l.max {return limitMax}
+    if l.perIP > 0 && l.ips[ip] >= l.perIP {return limitIP}
+    return ""
+}
+
+func (l *limiter) report() {
+    metrics.queued.with().set(int64(l.queued))
+    metrics.remoteIPs.with().set(int64(len(l.ips)))
+}
+
+// acquire takes a slot for ip, waiting up to wait for one to be released, otherwise it reports which limit is hit
+func (l *limiter) acquire(ip string, wait time.Duration) (bool, string) {
+    var timeout <-chan time.Time
+    l.Lock()
+    defer l.Unlock()
+    for {
+        reason := l.full(ip)
+        if reason == "" {
+            l.total++
+            l.ips[ip]++
+            l.report()
+            return true, ""
+        }
+        if wait <= 0 {return false, reason}
+        if timeout == nil {
+            timer := time.NewTimer(wait)
+            defer timer.Stop()
+            timeout = timer.C
+        }
+        wake := l.wake
+        l.queued++
+        l.report()
+        l.Unlock()
+        expired := false
+        select {
+        case <-wake:
+        case <-timeout: expired = true
+        }
+        l.Lock()
+        l.queued--
+        l.report()
+        if expired {
+            if reason := l.full(ip); reason != "" {return false, reason}
+        }
+    }
+}
+
+func (l *limiter) release(ip string) {
+    l.Lock()
+    defer l.Unlock()
+    l.total--
+    if l.ips[ip]--; l.ips[ip] <= 0 { delete(l.ips, ip) }
+    l.report()
+    close(l.wake)
+    l.wake = make(chan struct{})
+}
+
+// admit serves a connection once the limiter lets it in, over limit connections are closed
+func (s *CacheServer) admit(c net.Conn, ns *Namespace) {
+    if s.limits == nil {
+        s.serve(c, ns)
+        return
+    }
+    ip, _, err := net.SplitHostPort(c.RemoteAddr().String())
+    if err != nil { ip = c.RemoteAddr().String() }
+    if ok, reason := s.limits.acquire(ip, s.LimitWait); !ok {
+        c.Close()
+        s.group.Done() /* added by accept */
+        metrics.rejected.with(ns.Name, reason).add(1)
+        logger.Warn("connection rejected", zap.String("addr", c.RemoteAddr().String()), zap.String("limit", reason))
+        return
+    }
+    defer s.limits.release(ip)
+    s.serve(c, ns)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+    "bytes"
+    "net"
+    "testing"
+    "time"
+)
+
+// remoteConn poses as a connection from ip
+type remoteConn struct {
+    net.Conn
+    ip string
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 50000} }
+
+// admitted opens a session from ip through connection limits
+func (h *harness) admitted(ip string, log *bytes.Buffer) *session {
+    c, p := net.Pipe()
+    h.server.group.Add(1) /* as accept does */
+    go h.server.admit(remoteConn{Conn: p, ip: ip}, h.server.fallback())
+    c.SetDeadline(time.Now().Add(10 * time.Second))
+    h.t.Cleanup(func() { c.Close() })
+    return &session{t: h.t, c: c, log: log}
+}
+
+func TestLimitConnections(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.MaxConns, s.MaxConnsPerIP = 2, 1
+        s.limits = newLimiter(s.MaxConns, s.MaxConnsPerIP) /* as Listen does */
+    })
+    base := map[string]int64{}
+    for _, reason := range []string{limitMax, limitIP} { base[reason] = metrics.rejected.with(defaultNamespace, reason).get() }
+    var log bytes.Buffer
+    handshake := func(s *session) *session {
+        s.send("fe")
+        s.expect("000000fe")
+        return s
+    }
+
+    a := handshake(h.admitted("10.0.0.1", &log))
+    h.admitted("10.0.0.1", &log).dropped(time.Second)
+    b := handshake(h.admitted("10.0.0.2", &log))
+    h.admitted("10.0.0.3", &log).dropped(time.Second)
+    for reason, n := range map[string]int64{limitIP: 1, limitMax: 1} {
+        if c := metrics.rejected.with(defaultNamespace, reason).get() - base[reason]; c != n { t.Errorf("%d rejected by %s limit, want %d", c, reason, n) }
+    }
+
+    /* slots are given back once connections close */
+    for _, s := range []*session{a, b} {
+        s.send("qq")
+        s.closed()
+    }
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+        h.server.limits.Lock()
+        total := h.server.limits.total
+        h.server.limits.Unlock()
+        if total == 0 {break}
+        if time.Now().After(deadline) {t.Fatalf("%d slots not released", total)}
+    }
+    handshake(h.admitted("10.0.0.1", &log))
+    handshake(h.admitted("10.0.0.3", &log))
+}
+
+func TestLimitWait(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.MaxConns, s.LimitWait = 1, 5 * time.Second
+        s.limits = newLimiter(s.MaxConns, s.MaxConnsPerIP)
+    })
+    var log bytes.Buffer
+    a := h.admitted("10.0.0.1", &log)
+    a.send("fe")
+    a.expect("000000fe")
+
+    /* queued until a slot is released rather than rejected */
+    b := h.admitted("10.0.0.2", &log)
+    queued := make(chan struct{})
+    go func() {
+        defer close(queued)
+        b.c.Write([]byte("fe"))
+    }()
+    select {
+    case <-queued: t.Fatal("connection served over limit")
+    case <-time.After(200 * time.Millisecond):
+    }
+    a.send("qq")
+    a.closed()
+    <-queued
+    b.expect("000000fe")
+}
@@ -2,12 +2,16 @@ package server
 
 import (
     "bytes"
+    "container/list"
+    "crypto/sha256"
     "errors"
     "fmt"
     "go.uber.org/zap"
+    "hash"
     "io"
-    "os"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
     "unsafe"
 )
@@ -17,14 +21,24 @@ type File struct {
     name string
     size int64
     c    bool
+    t    bool /* staged upload, cached on commit */
+    done bool /* staged upload committed or aborted */
     m    *bytes.Buffer
-    f    *os.File
+    e    *memEntity /* memory cache entry m belongs to */
+    s    Storage
+    o    Object
+    u    Upload
+    h    hash.Hash
     w    io.Writer
     r    io.Reader
 }
 
 func (f *File) Read(p []byte) (int, error) {
-    if f.r == nil { if f.f != nil {f.r = f.f} else {f.r = f.m} }
+    if f.r == nil {
+        if f.o == nil {f.r = f.m} else if f.m != nil && !f.c {
+            f.r = io.TeeReader(f.o, f.m) /* fill memory cache on the way out */
+        } else {f.r = f.o}
+    }
     return f.r.Read(p)
 }
 
@@ -32,26 +46,65 @@ func (f *File) Write(p []byte) (int, error) {
     if f.w == nil {
         var w []io.Writer
         if f.m != nil { w = append(w, f.m) }
-        if f.f != nil { w = append(w, f.f) }
+        if f.u != nil { w = append(w, f.u) }
+        if f.h != nil { w = append(w, f.h) }
         f.w = io.MultiWriter(w...)
     }
     return f.w.Write(p)
 }
 
 func (f *File) Close() error {
-    defer func() {
-        if err := f.tryCache(); err == mcache.errors.cacherr {
-            f.m.Reset()
-            logger.Debug("pool", zap.Uintptr("put", uintptr(unsafe.Pointer(f.m))))
-            f.m = nil
-        }
-    }()
-    if f.f != nil { return f.f.Close() }
+    var err error
+    if f.o != nil { err = f.o.Close() }
+    if f.t {return err}
+    if f.e != nil {
+        mcache.core.release(f.e)
+        f.e, f.m = nil, nil
+        return err
+    }
+    if err != nil {
+        /* bytes read may be corrupt or cut short */
+        if f.m != nil { putBuffer(f.m.Bytes()) }
+        f.m = nil
+        return err
+    }
+    f.cache()
     return nil
 }
 
+func (f *File) cache() {
+    if err := f.tryCache(); err == mcache.errors.cacherr {
+        putBuffer(f.m.Bytes())
+        f.m = nil
+    }
+}
+
+// Commit publishes a staged upload along with its checksum, callers cache it once everything committed
+// together is in, a failed one is left to Abort
+func (f *File) Commit() error {
+    if f.h != nil {
+        if err := writeChecksum(f.s, f.name, f.h.Sum(nil)); err != nil {return err}
+    }
+    f.done = true /* upload is gone either way */
+    if err := f.u.Commit(); err != nil {
+        f.s.Delete(f.name + checksumExt)
+        return err
+    }
+    f.t = false
+    return nil
+}
+
+// Abort discards a staged upload, after Commit it only releases memory cache buffer
+func (f *File) Abort() error {
+    if f.m != nil { putBuffer(f.m.Bytes()) }
+    f.m = nil
+    if f.done {return nil}
+    f.done = true
+    return f.u.Abort()
+}
+
 func (f *File) tryCache() error {
-    if f.m != nil && f.f != nil {
+    if f.m != nil && (f.o != nil || f.u != nil) {
         if f.size == int64(f.m.Len()) {
             mcache.core.put(f.uuid, f.m)
             return nil
@@ -63,92 +116,200 @@ func (f *File) tryCache() error {
 
 func (f *File) Name() string { return f.name }
 
+// footprint is how many bytes a committed upload of size takes in storage, checksum sidecar included
+func (f *File) footprint(size int64) int64 {
+    if f.h != nil {return size + checksumSize}
+    return size
+}
+
 type memEntity struct {
-    data *bytes.Buffer
-    uuid string
-    size int64
-    hit  int
-    ts   int64
+    hit   int64 /* atomic */
+    ts    int64 /* atomic */
+    data  *bytes.Buffer
+    uuid  string
+    size  int64
+    shard *memShard
+    refs  int  /* files serving data */
+    gone  bool /* removed from cache, data is recycled once refs drops to 0 */
 }
 
+// memShards is the number of independently locked parts of memory cache
+const memShards = 32
+
+// memCache keeps small artifacts in memory up to capacity bytes, it's split into shards by hash of uuid
+// and each of them evicts its least recently used ones, so that gets of different artifacts rarely wait for each other
 type memCache struct {
-    capacity int
-    lookups  map[string]*memEntity
-    library  []*memEntity
-    size     int64
-    sync.RWMutex
-}
-
-func (m *memCache) remove(uuid string) {
-    if entity, ok := m.lookups[uuid]; ok {
-        delete(m.lookups, entity.uuid)
-        m.size -= int64(entity.data.Cap())
-        for i := 0; i < len(m.library); i++ {
-            e := m.library[i]
-            if e.uuid == uuid {
-                m.library = append(m.library[:i], m.library[i+1:]...)
-                break
-            }
-        }
+    size     int64 /* atomic, bytes held by all shards */
+    count    int64 /* atomic, entries held by all shards */
+    capacity int64
+    shards   []*memShard
+}
+
+type memShard struct {
+    index   int
+    lookups map[string]*list.Element
+    library *list.List
+    sync.Mutex
+}
+
+func newMemCache(shards int) *memCache {
+    m := &memCache{}
+    for i := 0; i < shards; i++ { m.shards = append(m.shards, &memShard{index: i, lookups: make(map[string]*list.Element), library: list.New()}) }
+    return m
+}
+
+// shard picks the shard of uuid by FNV-1a
+func (m *memCache) shard(uuid string) *memShard {
+    h := uint32(2166136261)
+    for i := 0; i < len(uuid); i++ {
+        h ^= uint32(uuid[i])
+        h *= 16777619
+    }
+    return m.shards[h % uint32(len(m.shards))]
+}
+
+func (m *memCache) remove(shard *memShard, uuid string) {
+    if elem, ok := shard.lookups[uuid]; ok {
+        delete(shard.lookups, uuid)
+        shard.library.Remove(elem)
+        entity := elem.Value.(*memEntity)
+        atomic.AddInt64(&m.size, -int64(entity.data.Cap()))
+        atomic.AddInt64(&m.count, -1)
+        entity.gone = true
+        if entity.refs == 0 { putBuffer(entity.data.Bytes()) }
     }
 }
 
+// release is called once a file is done with data of entity
+func (m *memCache) release(entity *memEntity) {
+    shard := entity.shard
+    shard.Lock()
+    defer shard.Unlock()
+    if entity.refs--; entity.refs == 0 && entity.gone { putBuffer(entity.data.Bytes()) }
+}
+
 func (m *memCache) put(uuid string, data *bytes.Buffer) {
-    m.Lock()
-    defer m.Unlock()
+    shard := m.shard(uuid)
+    shard.Lock()
     logger.Debug("mcache", zap.String("put", uuid), zap.Int("size", data.Len()), zap.Uintptr("ptr", uintptr(unsafe.Pointer(data))))
-    m.remove(uuid) /* clean up old one */
-    entity := &memEntity{uuid: uuid, data: data, size: int64(data.Len()), ts: time.Now().UnixNano()}
-    m.lookups[uuid] = entity
-    m.library = append(m.library, entity)
-    m.size += int64(data.Cap())
-    if m.capacity < len(m.library) {
-        for i := 0; i < len(m.library); i++ {
-            entity := m.library[i]
-            if m.capacity < len(m.library) {
-                logger.Debug("mcache cls", zap.Int("cap", m.capacity), zap.Int("len", len(m.library)))
-                delete(m.lookups, entity.uuid)
-                m.library = append(m.library[:i], m.library[i+1:]...)
-                m.size -= int64(entity.data.Cap())
-                i--
-            } else { break }
+    m.remove(shard, uuid) /* clean up old one */
+    if int64(data.Cap()) > m.capacity {
+        shard.Unlock()
+        putBuffer(data.Bytes())
+        return
+    }
+    entity := &memEntity{uuid: uuid, data: data, size: int64(data.Len()), ts: time.Now().UnixNano(), shard: shard}
+    shard.lookups[uuid] = shard.library.PushFront(entity)
+    atomic.AddInt64(&m.count, 1)
+    size := atomic.AddInt64(&m.size, int64(data.Cap()))
+    for size > m.capacity && shard.library.Len() > 1 { size = m.evict(shard) }
+    shard.Unlock()
+    /* capacity is shared, take the rest from other shards */
+    for i := 1; size > m.capacity && i < len(m.shards); i++ {
+        other := m.shards[(shard.index + i) % len(m.shards)]
+        other.Lock()
+        for size > m.capacity && other.library.Len() > 0 { size = m.evict(other) }
+        other.Unlock()
+        size = atomic.LoadInt64(&m.size)
+    }
+}
+
+// evict removes least recently used entry of locked shard and returns size left in memory cache
+func (m *memCache) evict(shard *memShard) int64 {
+    entity := shard.library.Back().Value.(*memEntity)
+    logger.Debug("mcache cls", zap.Int64("cap", m.capacity), zap.Int64("size", atomic.LoadInt64(&m.size)), zap.String("uuid", entity.uuid))
+    m.remove(shard, entity.uuid)
+    metrics.evictions.with("memory").add(1)
+    return atomic.LoadInt64(&m.size)
+}
+
+// delete removes entry of uuid
+func (m *memCache) delete(uuid string) {
+    shard := m.shard(uuid)
+    shard.Lock()
+    defer shard.Unlock()
+    m.remove(shard, uuid)
+}
+
+func (m *memCache) has(uuid string) bool {
+    shard := m.shard(uuid)
+    shard.Lock()
+    defer shard.Unlock()
+    _, ok := shard.lookups[uuid]
+    return ok
+}
+
+// drop removes entries whose uuid starts with prefix
+func (m *memCache) drop(prefix string) int {
+    num := 0
+    for _, shard := range m.shards {
+        shard.Lock()
+        for uuid := range shard.lookups {
+            if strings.HasPrefix(uuid, prefix) {
+                m.remove(shard, uuid)
+                num++
+            }
         }
+        shard.Unlock()
     }
+    return num
+}
+
+// flush empties memory cache and reports how many entries and bytes are released
+func (m *memCache) flush() (int, int64) {
+    num, size := 0, int64(0)
+    for _, shard := range m.shards {
+        shard.Lock()
+        for uuid, elem := range shard.lookups {
+            num++
+            size += int64(elem.Value.(*memEntity).data.Cap())
+            m.remove(shard, uuid)
+        }
+        shard.Unlock()
+    }
+    return num, size
+}
+
+// len reports entries and bytes held in memory cache
+func (m *memCache) len() (int, int64) {
+    return int(atomic.LoadInt64(&m.count)), atomic.LoadInt64(&m.size)
 }
 
 func (m *memCache) stat() {
     for {
-        m.RLock()
-        var size int64
-        for i := 0; i < len(m.library); i++ {
-            entity := m.library[i]
-            size += int64(entity.data.Cap())
-        }
-        m.RUnlock()
-        logger.Debug("mcache", zap.Int("library", len(m.library)),
-            zap.Int("lookups", len(m.lookups)),
+        entries, size := m.len()
+        logger.Debug("mcache", zap.Int("entries", entries),
+            zap.Int("shards", len(m.shards)),
             zap.Int64("size", size))
         time.Sleep(10 * time.Second)
     }
 }
 
-func (m *memCache) get(uuid string) (*bytes.Buffer, error) {
-    m.RLock()
-    defer m.RUnlock()
-    if entity, ok := m.lookups[uuid]; ok {
-        entity.hit++
-        logger.Debug("mcache", zap.String("get", uuid),
-            zap.Uintptr("ptr", uintptr(unsafe.Pointer(entity.data))),
-            zap.Int("size", entity.data.Len()),
-            zap.Int("data", int(entity.size)),
-            zap.Int("cap", entity.data.Cap()))
-        return entity.data, nil
+// get pins entity of uuid, its data stays valid until release
+func (m *memCache) get(uuid string) (*memEntity, error) {
+    shard := m.shard(uuid)
+    shard.Lock()
+    defer shard.Unlock()
+    if elem, ok := shard.lookups[uuid]; ok {
+        entity := elem.Value.(*memEntity)
+        atomic.AddInt64(&entity.hit, 1)
+        atomic.StoreInt64(&entity.ts, time.Now().UnixNano())
+        entity.refs++
+        shard.library.MoveToFront(elem)
+        if ce := logger.Check(zap.DebugLevel, "mcache"); ce != nil { /* spare building fields on hot path */
+            ce.Write(zap.String("get", uuid),
+                zap.Uintptr("ptr", uintptr(unsafe.Pointer(entity.data))),
+                zap.Int("size", entity.data.Len()),
+                zap.Int64("data", entity.size),
+                zap.Int("cap", entity.data.Cap()))
+        }
+        return entity, nil
     }
     return nil, mcache.errors.unavailable
 }
 
 var mcache struct {
-    core   memCache
+    core   *memCache
     limit  int64
     errors struct {
         unavailable error
@@ -160,37 +321,38 @@ func init() {
     mcache.limit = 2 << 20 // 2M
     mcache.errors.unavailable = errors.New("not available for caching")
     mcache.errors.cacherr = errors.New("cache error")
-    mcache.core.lookups = make(map[string]*memEntity)
+    mcache.core = newMemCache(memShards)
 }
 
-func Open(name string, uuid string) (*File, error) {
-    if mcache.core.capacity > 0 {
-        if data, err := mcache.core.get(uuid); err == nil {
-            return &File{m: data, uuid: uuid, c: true, size: int64(data.Len())}, nil
+// Open reads an artifact from memory cache or store, it's kept out of memory cache if uuid is empty
+func Open(store Storage, key string, uuid string) (*File, error) {
+    if mcache.core.capacity > 0 && uuid != "" {
+        if entity, err := mcache.core.get(uuid); err == nil {
+            return &File{m: entity.data, e: entity, uuid: uuid, c: true, size: int64(entity.data.Len())}, nil
         }
     }
-    file, err := os.Open(name)
+    o, err := store.Get(key)
     if err != nil {return nil, err}
-    f := &File{f: file, name: name, uuid: uuid}
-    if s, err := file.Stat(); err == nil && s.Size() > 0 {
-        f.size = s.Size()
-        if mcache.core.capacity > 0 && s.Size() < mcache.limit {
-            f.m = bytes.NewBuffer(make([]byte, 0, s.Size()))
+    f := &File{s: store, o: o, name: key, uuid: uuid}
+    if size := o.Size(); size > 0 {
+        f.size = size
+        if mcache.core.capacity > 0 && uuid != "" && size < mcache.limit {
+            f.m = bytes.NewBuffer(getBuffer(int(size))[:0])
         }
     } else {
-        file.Close()
-        return nil, fmt.Errorf("unavailable: %s", name)
+        o.Close()
+        return nil, fmt.Errorf("unavailable: %s", key)
     }
 
     return f, nil
 }
 
-func NewFile(name string, uuid string, size int64) (*File, error) {
-    file, err := os.OpenFile(name, os.O_CREATE | os.O_WRONLY, 0700)
+func NewFile(store Storage, key string, uuid string, size int64) (*File, error) {
+    u, err := store.Put(key)
     if err != nil {return nil, err}
-    f := &File{f: file, name: name, uuid: uuid}
-    if mcache.core.capacity > 0 && size < mcache.limit {
-        f.m = bytes.NewBuffer(make([]byte, 0, size))
+    f := &File{s: store, u: u, name: key, uuid: uuid, t: true, h: sha256.New()}
+    if mcache.core.capacity > 0 && uuid != "" && size < mcache.limit {
+        f.m = bytes.NewBuffer(getBuffer(int(size))[:0])
         f.size = size
     }
     return f, nil
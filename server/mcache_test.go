@@ -0,0 +1,100 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "runtime"
+    "sync"
+    "testing"
+)
+
+func memData(size int) *bytes.Buffer {
+    data := bytes.NewBuffer(getBuffer(size)[:0])
+    data.Write(bytes.Repeat([]byte{1}, size))
+    return data
+}
+
+func TestMemCacheRecycle(t *testing.T) {
+    m := newMemCache(memShards)
+    m.capacity = 1 << 20
+    p := poolOf(8 << 10)
+    m.put("a", memData(5000))
+
+    e, err := m.get("a")
+    if err != nil {t.Fatal(err)}
+    puts := p.puts.get()
+    m.flush()
+    if n := p.puts.get() - puts; n != 0 { t.Fatalf("recycled %d buffers still in use", n) }
+    if e.data.Len() != 5000 { t.Fatalf("size %d", e.data.Len()) }
+    m.release(e)
+    if n := p.puts.get() - puts; n != 1 { t.Fatalf("recycled %d buffers, want 1", n) }
+}
+
+func TestMemCacheCapacity(t *testing.T) {
+    m := newMemCache(memShards)
+    m.capacity = 64 << 10
+    for i := 0; i < 100; i++ { m.put(fmt.Sprintf("ns/%d", i), memData(4 << 10)) }
+    if n, size := m.len(); size > m.capacity || n != 16 { t.Fatalf("%d entries of %d bytes, capacity %d", n, size, m.capacity) }
+    if !m.has("ns/99") { t.Fatalf("latest entry evicted") }
+
+    /* a single entry above capacity isn't taken */
+    m.put("ns/big", memData(128 << 10))
+    if n, _ := m.len(); n != 16 || m.has("ns/big") { t.Fatalf("%d entries left, big one cached %v", n, m.has("ns/big")) }
+}
+
+// TestMemCacheConcurrent is meant to run with -race
+func TestMemCacheConcurrent(t *testing.T) {
+    m := newMemCache(memShards)
+    m.capacity = 256 << 10
+    var wg sync.WaitGroup
+    for w := 0; w < 16; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < 500; i++ {
+                uuid := fmt.Sprintf("ns/%d", (w * 7 + i) % 64)
+                switch i % 10 {
+                case 0: m.put(uuid, memData(4 << 10))
+                case 1: m.drop(fmt.Sprintf("ns/%d", i % 64))
+                case 2: m.has(uuid)
+                default:
+                    if e, err := m.get(uuid); err == nil {
+                        if e.data.Len() != 4 << 10 { t.Errorf("size %d", e.data.Len()) }
+                        m.release(e)
+                    }
+                }
+            }
+        }(w)
+    }
+    wg.Wait()
+    if _, size := m.len(); size > m.capacity { t.Fatalf("%d bytes above capacity %d", size, m.capacity) }
+    m.flush()
+    if n, size := m.len(); n != 0 || size != 0 { t.Fatalf("%d entries of %d bytes after flush", n, size) }
+}
+
+// BenchmarkMemCacheGet serves hits to 256 concurrent readers, a single shard stands for the former global lock
+func BenchmarkMemCacheGet(b *testing.B) {
+    const readers, entries = 256, 1024
+    for _, shards := range []int{1, memShards} {
+        b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+            m := newMemCache(shards)
+            m.capacity = 1 << 30
+            uuids := make([]string, entries)
+            for i := range uuids {
+                uuids[i] = fmt.Sprintf("ns/%032x", i)
+                m.put(uuids[i], memData(1 << 10))
+            }
+            b.SetParallelism((readers + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                i := 0
+                for pb.Next() {
+                    e, err := m.get(uuids[i % entries])
+                    if err != nil { b.Error(err);return }
+                    m.release(e)
+                    i += 7
+                }
+            })
+        })
+    }
+}
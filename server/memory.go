@@ -0,0 +1,129 @@
+package server
+
+import (
+    "bytes"
+    "errors"
+    "sync"
+    "time"
+)
+
+type memObject struct {
+    data  []byte
+    mtime time.Time
+}
+
+// MemoryStorage keeps artifacts in a map, it's meant for tests
+type MemoryStorage struct {
+    objects     map[string]*memObject
+    quarantined map[string]*memObject
+    sync.Mutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+    return &MemoryStorage{objects: make(map[string]*memObject), quarantined: make(map[string]*memObject)}
+}
+
+type memReader struct {
+    *bytes.Reader
+}
+
+func (r memReader) Close() error { return nil }
+
+func (m *MemoryStorage) Get(key string) (Object, error) {
+    m.Lock()
+    defer m.Unlock()
+    if o, ok := m.objects[key]; ok { return memReader{Reader: bytes.NewReader(o.data)}, nil }
+    return nil, ErrMiss
+}
+
+type memUpload struct {
+    bytes.Buffer
+    m    *MemoryStorage
+    key  string
+    done bool
+}
+
+func (u *memUpload) Commit() error {
+    if u.done {return errors.New("upload already finished")}
+    u.done = true
+    u.m.Lock()
+    defer u.m.Unlock()
+    u.m.objects[u.key] = &memObject{data: u.Bytes(), mtime: time.Now()}
+    return nil
+}
+
+func (u *memUpload) Abort() error {
+    u.done = true
+    u.Reset()
+    return nil
+}
+
+func (m *MemoryStorage) Put(key string) (Upload, error) {
+    return &memUpload{m: m, key: key}, nil
+}
+
+func (m *MemoryStorage) Stat(key string) (Info, error) {
+    m.Lock()
+    defer m.Unlock()
+    if o, ok := m.objects[key]; ok { return Info{Key: key, Size: int64(len(o.data)), Mtime: o.mtime}, nil }
+    return Info{}, ErrMiss
+}
+
+func (m *MemoryStorage) Delete(key string) error {
+    m.Lock()
+    defer m.Unlock()
+    if _, ok := m.objects[key]; !ok {return ErrMiss}
+    delete(m.objects, key)
+    return nil
+}
+
+func (m *MemoryStorage) Walk(fn func(info Info) error) error {
+    m.Lock()
+    infos := make([]Info, 0, len(m.objects))
+    for key, o := range m.objects { infos = append(infos, Info{Key: key, Size: int64(len(o.data)), Mtime: o.mtime}) }
+    m.Unlock()
+    for _, info := range infos {
+        if err := fn(info); err != nil {return err}
+    }
+    return nil
+}
+
+// Quarantine moves an artifact aside, it's no longer served or walked
+func (m *MemoryStorage) Quarantine(key string) error {
+    m.Lock()
+    defer m.Unlock()
+    o, ok := m.objects[key]
+    if !ok {return ErrMiss}
+    delete(m.objects, key)
+    m.quarantined[key] = o
+    return nil
+}
+
+func (m *MemoryStorage) DeleteQuarantined(key string) error {
+    m.Lock()
+    defer m.Unlock()
+    if _, ok := m.quarantined[key]; !ok {return ErrMiss}
+    delete(m.quarantined, key)
+    return nil
+}
+
+func (m *MemoryStorage) WalkQuarantined(fn func(info Info) error) error {
+    m.Lock()
+    infos := make([]Info, 0, len(m.quarantined))
+    for key, o := range m.quarantined { infos = append(infos, Info{Key: key, Size: int64(len(o.data)), Mtime: o.mtime}) }
+    m.Unlock()
+    for _, info := range infos {
+        if err := fn(info); err != nil {return err}
+    }
+    return nil
+}
+
+// Corrupt overwrites stored bytes in place to simulate bit rot
+func (m *MemoryStorage) Corrupt(key string, data []byte) error {
+    m.Lock()
+    defer m.Unlock()
+    o, ok := m.objects[key]
+    if !ok {return ErrMiss}
+    o.data = append([]byte(nil), data...)
+    return nil
+}
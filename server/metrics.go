@@ -0,0 +1,256 @@
+package server
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+type sample struct {
+    labels []string
+    n      int64
+}
+
+func (s *sample) add(d int64) { atomic.AddInt64(&s.n, d) }
+func (s *sample) set(v int64) { atomic.StoreInt64(&s.n, v) }
+func (s *sample) get() int64  { return atomic.LoadInt64(&s.n) }
+
+type histogram struct {
+    labels []string
+    bounds []float64
+    counts []uint64
+    count  uint64
+    sum    float64
+    sync.Mutex
+}
+
+func (h *histogram) observe(v float64) {
+    h.Lock()
+    defer h.Unlock()
+    for i, b := range h.bounds {
+        if v <= b { h.counts[i]++ }
+    }
+    h.count++
+    h.sum += v
+}
+
+// metricVec is a counter or gauge family partitioned by label values
+type metricVec struct {
+    name   string
+    help   string
+    kind   string
+    labels []string
+    series map[string]*sample
+    sync.Mutex
+}
+
+func (m *metricVec) with(values ...string) *sample {
+    for i, label := range m.labels {
+        if label == "namespace" && values[i] == probeNamespace {return &sample{labels: values}} /* not exported */
+    }
+    key := strings.Join(values, "\xff")
+    m.Lock()
+    defer m.Unlock()
+    s, ok := m.series[key]
+    if !ok {
+        s = &sample{labels: values}
+        m.series[key] = s
+    }
+    return s
+}
+
+func (m *metricVec) write(w io.Writer) {
+    m.Lock()
+    samples := make([]*sample, 0, len(m.series))
+    for _, s := range m.series { samples = append(samples, s) }
+    m.Unlock()
+    sort.Slice(samples, func(i, j int) bool { return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff") })
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, helpEscaper.Replace(m.help), m.name, m.kind)
+    for _, s := range samples { fmt.Fprintf(w, "%s%s %d\n", m.name, formatLabels(m.labels, s.labels, "", ""), s.get()) }
+}
+
+type histogramVec struct {
+    name   string
+    help   string
+    labels []string
+    bounds []float64
+    series map[string]*histogram
+    sync.Mutex
+}
+
+func (m *histogramVec) with(values ...string) *histogram {
+    key := strings.Join(values, "\xff")
+    m.Lock()
+    defer m.Unlock()
+    h, ok := m.series[key]
+    if !ok {
+        h = &histogram{labels: values, bounds: m.bounds, counts: make([]uint64, len(m.bounds))}
+        m.series[key] = h
+    }
+    return h
+}
+
+func (m *histogramVec) write(w io.Writer) {
+    m.Lock()
+    series := make([]*histogram, 0, len(m.series))
+    for _, h := range m.series { series = append(series, h) }
+    m.Unlock()
+    sort.Slice(series, func(i, j int) bool { return strings.Join(series[i].labels, "\xff") < strings.Join(series[j].labels, "\xff") })
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, helpEscaper.Replace(m.help), m.name)
+    for _, h := range series {
+        h.Lock()
+        for i, b := range h.bounds {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, h.labels, "le", strconv.FormatFloat(b, 'g', -1, 64)), h.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, h.labels, "le", "+Inf"), h.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, h.labels, "", ""), strconv.FormatFloat(h.sum, 'g', -1, 64))
+        fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, h.labels, "", ""), h.count)
+        h.Unlock()
+    }
+}
+
+// gaugeFunc reports a value computed at scrape time
+type gaugeFunc struct {
+    name string
+    help string
+    fn   func() int64
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, helpEscaper.Replace(g.help), g.name, g.name, g.fn())
+}
+
+// exposition format escapes only backslash and line feed in help, and double quote as well in label values
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extra string, value string) string {
+    var pairs []string
+    for i, name := range names {
+        v := ""
+        if i < len(values) { v = values[i] }
+        pairs = append(pairs, name + "=\"" + labelEscaper.Replace(v) + "\"")
+    }
+    if extra != "" { pairs = append(pairs, extra + "=\"" + labelEscaper.Replace(value) + "\"") }
+    if len(pairs) == 0 {return ""}
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var registry struct {
+    collectors []interface{ write(w io.Writer) }
+    sync.Mutex
+}
+
+func register(c interface{ write(w io.Writer) }) {
+    registry.Lock()
+    defer registry.Unlock()
+    registry.collectors = append(registry.collectors, c)
+}
+
+func newCounter(name string, help string, labels ...string) *metricVec {
+    m := &metricVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*sample)}
+    register(m)
+    return m
+}
+
+func newGauge(name string, help string, labels ...string) *metricVec {
+    m := &metricVec{name: name, help: help, kind: "gauge", labels: labels, series: make(map[string]*sample)}
+    register(m)
+    return m
+}
+
+func newGaugeFunc(name string, help string, fn func() int64) *gaugeFunc {
+    g := &gaugeFunc{name: name, help: help, fn: fn}
+    register(g)
+    return g
+}
+
+func newHistogram(name string, help string, bounds []float64, labels ...string) *histogramVec {
+    m := &histogramVec{name: name, help: help, labels: labels, bounds: bounds, series: make(map[string]*histogram)}
+    register(m)
+    return m
+}
+
+var metrics struct {
+    gets        *metricVec
+    puts        *metricVec
+    putBytes    *metricVec
+    discarded   *metricVec
+    getBytes    *metricVec
+    connections *metricVec
+    evictions   *metricVec
+    diskEntries *metricVec
+    diskBytes   *metricVec
+    upstream    *metricVec
+    corrupt     *metricVec
+    auth        *metricVec
+    tlsReloads  *metricVec
+    timeouts    *metricVec
+    rejected    *metricVec
+    queued      *metricVec
+    remoteIPs   *metricVec
+    throttled   *metricVec
+    malformed   *metricVec
+    zeroCopy    *metricVec
+    swept       *metricVec
+    sweptBytes  *metricVec
+    poolGets    *metricVec
+    poolPuts    *metricVec
+    poolAllocs  *metricVec
+    latency     *histogramVec
+}
+
+func init() {
+    metrics.gets = newCounter("gocache_get_total", "Get requests by artifact type and result.", "namespace", "type", "result")
+    metrics.getBytes = newCounter("gocache_get_bytes_total", "Artifact bytes sent to clients.", "namespace", "type")
+    metrics.puts = newCounter("gocache_put_total", "Artifacts uploaded by type.", "namespace", "type")
+    metrics.putBytes = newCounter("gocache_put_bytes_total", "Artifact bytes received from clients.", "namespace", "type")
+    metrics.discarded = newCounter("gocache_put_discarded_total", "Artifacts uploaded and discarded in readonly mode.", "namespace", "type")
+    metrics.connections = newGauge("gocache_connections", "Active client connections.", "namespace")
+    newGaugeFunc("gocache_mcache_entries", "Artifacts held in memory cache.", func() int64 {
+        entries, _ := mcache.core.len()
+        return int64(entries)
+    })
+    newGaugeFunc("gocache_mcache_bytes", "Bytes held in memory cache.", func() int64 {
+        _, size := mcache.core.len()
+        return size
+    })
+    metrics.evictions = newCounter("gocache_evictions_total", "Artifacts evicted by cache tier.", "tier")
+    metrics.diskEntries = newGauge("gocache_disk_entries", "Artifacts tracked on disk.", "namespace")
+    metrics.diskBytes = newGauge("gocache_disk_bytes", "Bytes of artifacts tracked on disk.", "namespace")
+    metrics.upstream = newCounter("gocache_upstream_total", "Upstream requests by operation and result.", "op", "result")
+    metrics.corrupt = newCounter("gocache_corrupt_total", "Artifacts failing checksum verification and quarantined.", "namespace")
+    metrics.auth = newCounter("gocache_auth_total", "Authentication attempts and denied commands by result.", "namespace", "result")
+    metrics.tlsReloads = newCounter("gocache_tls_reload_total", "TLS certificate reloads by result.", "result")
+    metrics.timeouts = newCounter("gocache_timeouts_total", "Connections closed on timeout by reason.", "namespace", "reason")
+    metrics.rejected = newCounter("gocache_connections_rejected_total", "Connections rejected by limit hit.", "namespace", "limit")
+    metrics.queued = newGauge("gocache_connections_queued", "Connections waiting for a slot under connection limits.")
+    metrics.remoteIPs = newGauge("gocache_connection_ips", "Distinct remote ips connected under connection limits.")
+    metrics.throttled = newCounter("gocache_throttle_wait_milliseconds_total", "Time body transfers waited for bandwidth by direction.", "direction")
+    metrics.malformed = newCounter("gocache_protocol_errors_total", "Connections dropped on malformed input or recovered panics by reason.", "namespace", "reason")
+    metrics.zeroCopy = newCounter("gocache_zero_copy_bytes_total", "Artifact bytes handed between socket and file through ReadFrom, sendfile or splice where the platform has them, by direction.", "direction")
+    metrics.swept = newCounter("gocache_temp_swept_total", "Stale temp upload files removed.", "namespace")
+    metrics.sweptBytes = newCounter("gocache_temp_swept_bytes_total", "Bytes of stale temp upload files removed.", "namespace")
+    metrics.poolGets = newCounter("gocache_pool_gets_total", "Buffers taken from pool by size class.", "class")
+    metrics.poolPuts = newCounter("gocache_pool_puts_total", "Buffers returned to pool by size class.", "class")
+    metrics.poolAllocs = newCounter("gocache_pool_allocs_total", "Buffers allocated on pool miss by size class.", "class")
+    metrics.latency = newHistogram("gocache_command_duration_seconds", "Protocol command latency.",
+        []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60}, "command")
+}
+
+// ServeMetrics writes all metrics in the Prometheus text exposition format
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    b := bufio.NewWriter(w)
+    defer b.Flush()
+    registry.Lock()
+    collectors := registry.collectors
+    registry.Unlock()
+    for _, c := range collectors { c.write(b) }
+}
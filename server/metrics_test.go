@@ -0,0 +1,93 @@
+package server
+
+import (
+    "bytes"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// scrape parses exposition of ServeMetrics into samples keyed by name and labels, it checks every sample
+// follows HELP and TYPE of its own family
+func scrape(t *testing.T) (map[string]float64, string) {
+    t.Helper()
+    w := httptest.NewRecorder()
+    ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+    if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") { t.Errorf("content type %q", ct) }
+    text := w.Body.String()
+    samples := map[string]float64{}
+    family, kind, help := "", "", ""
+    for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+        if strings.HasPrefix(line, "# HELP ") {
+            help = strings.Fields(line)[2]
+            continue
+        }
+        if strings.HasPrefix(line, "# TYPE ") {
+            fields := strings.Fields(line)
+            if len(fields) != 4 || fields[2] != help { t.Fatalf("%q not after HELP of its family", line) }
+            family, kind = fields[2], fields[3]
+            continue
+        }
+        i := strings.LastIndexByte(line, ' ')
+        if i < 0 { t.Fatalf("malformed sample %q", line) }
+        name := line[:i]
+        if j := strings.IndexByte(name, '{'); j >= 0 { name = name[:j] }
+        switch {
+        case name == family:
+        case kind == "histogram" && (name == family + "_bucket" || name == family + "_sum" || name == family + "_count"):
+        default: t.Fatalf("sample %q outside family %s of %s", line, family, kind)
+        }
+        v, err := strconv.ParseFloat(line[i+1:], 64)
+        if err != nil { t.Fatalf("sample %q: %v", line, err) }
+        samples[line[:i]] = v
+    }
+    return samples, text
+}
+
+func TestServeMetrics(t *testing.T) {
+    h := newHarness(t, "pipe", nil)
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0xe1)
+    s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+    s.send(getCmd(RequestTypeBin, id))
+    s.expect(hit(RequestTypeBin, id, testBody(RequestTypeBin, id)))
+    s.send("qq")
+    s.closed()
+    h.settle()
+    if err := h.server.selfCheck(5 * time.Second); err != nil {t.Fatal(err)}
+    h.server.probe.settle(t)
+
+    samples, text := scrape(t)
+    if strings.Contains(text, probeNamespace) { t.Error("self-check traffic exported") }
+    for _, series := range []string{`gocache_get_total{namespace="default",type="bin",result="hit"}`, `gocache_put_total{namespace="default",type="bin"}`} {
+        if samples[series] < 1 { t.Errorf("%s = %v", series, samples[series]) }
+    }
+
+    /* buckets are cumulative and +Inf one counts every observation */
+    for _, cmd := range []string{"ga", "pa"} {
+        labels := `command="` + cmd + `"`
+        last := 0.0
+        for _, le := range []string{".0005", ".001", ".005", ".01", ".05", ".1", ".5", "1", "5", "10", "30", "60", "+Inf"} {
+            if le[0] == '.' { le = "0" + le }
+            n, ok := samples[`gocache_command_duration_seconds_bucket{` + labels + `,le="` + le + `"}`]
+            if !ok || n < last { t.Fatalf("%s bucket le=%s: %v after %v", cmd, le, n, last) }
+            last = n
+        }
+        count, ok := samples[`gocache_command_duration_seconds_count{` + labels + `}`]
+        if !ok || count < 1 || count != last { t.Errorf("%s count %v, +Inf bucket %v", cmd, count, last) }
+        if sum, ok := samples[`gocache_command_duration_seconds_sum{` + labels + `}`]; !ok || sum <= 0 { t.Errorf("%s sum %v", cmd, sum) }
+    }
+}
+
+func TestMetricsEscape(t *testing.T) {
+    m := &metricVec{name: "test_total", help: "Help with \\ and\nline feed.", kind: "counter", labels: []string{"a", "b"}, series: make(map[string]*sample)}
+    m.with("quote \" backslash \\", "line\nfeed \x01 é").add(3)
+    var b bytes.Buffer
+    m.write(&b)
+    want := "# HELP test_total Help with \\\\ and\\nline feed.\n# TYPE test_total counter\n" +
+        "test_total{a=\"quote \\\" backslash \\\\\",b=\"line\\nfeed \x01 é\"} 3\n"
+    if b.String() != want { t.Errorf("exposition\n%s\nwant\n%s", b.String(), want) }
+}
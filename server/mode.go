@@ -0,0 +1,32 @@
+package server
+
+import "fmt"
+
+// Mode restricts what clients may do with the cache, it implements flag.Value
+type Mode int
+const (
+    ModeReadWrite Mode = iota
+    ModeReadOnly       // p payloads are drained and discarded
+    ModeWriteOnly      // g always reports a miss
+)
+
+func (m Mode) String() string {
+    switch m {
+    case ModeReadOnly: return "readonly"
+    case ModeWriteOnly: return "writeonly"
+    default: return "readwrite"
+    }
+}
+
+func (m *Mode) Set(v string) error {
+    switch v {
+    case "readwrite": *m = ModeReadWrite
+    case "readonly": *m = ModeReadOnly
+    case "writeonly": *m = ModeWriteOnly
+    default: return fmt.Errorf("mode %q not one of readwrite/readonly/writeonly", v)
+    }
+    return nil
+}
+
+func (m Mode) readable() bool { return m != ModeWriteOnly }
+func (m Mode) writable() bool { return m != ModeReadOnly }
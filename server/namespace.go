@@ -0,0 +1,136 @@
+package server
+
+import (
+    "fmt"
+    "go.uber.org/zap"
+    "path"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const defaultNamespace = "default"
+
+// probeNamespace names the private namespace of readiness self-check, no valid namespace is named so
+const probeNamespace = "~readyz"
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Namespace isolates artifacts of one project, clients select it by the port they connect to.
+// Every namespace has its own storage, disk quota and stats.
+type Namespace struct {
+    Name     string
+    Port     int
+    Path     string // defaults to <CacheServer.Path>/<Name>
+    DiskCap  int64
+    Storage  Storage
+    Upstream Upstream
+    Tokens   map[string]Role // connections must authenticate with one of them unless it's empty
+    store    Storage
+    temp     string
+    disk     *diskCache
+}
+
+// ParseNamespace parses name:port[:disk-cap], e.g. team-a:9967:200G
+func ParseNamespace(v string) (*Namespace, error) {
+    parts := strings.Split(v, ":")
+    if len(parts) < 2 || len(parts) > 3 {return nil, fmt.Errorf("namespace %q not in form of name:port[:disk-cap]", v)}
+    ns := &Namespace{Name: parts[0]}
+    if err := validNamespace(ns.Name); err != nil {return nil, err}
+    port, err := strconv.Atoi(parts[1])
+    if err != nil || port <= 0 || port > 65535 {return nil, fmt.Errorf("namespace %q port invalid: %s", ns.Name, parts[1])}
+    ns.Port = port
+    if len(parts) == 3 {
+        if ns.DiskCap, err = ParseByteSize(parts[2]); err != nil {return nil, err}
+    }
+    return ns, nil
+}
+
+func validNamespace(name string) error {
+    if !namespacePattern.MatchString(name) {return fmt.Errorf("namespace %q may only contain letters, digits, '-' and '_'", name)}
+    /* namespace directories live among those of default namespace */
+    if name == defaultNamespace || name == "temp" || name == "quarantine" {return fmt.Errorf("namespace %q is reserved", name)}
+    if len(name) == 2 {return fmt.Errorf("namespace %q clashes with artifact directories, use a longer name", name)}
+    return nil
+}
+
+// Namespaces is a flag.Value collecting repeated name:port[:disk-cap] flags
+type Namespaces []*Namespace
+
+func (n *Namespaces) String() string {
+    var s []string
+    for _, ns := range *n { s = append(s, ns.Name + ":" + strconv.Itoa(ns.Port)) }
+    return strings.Join(s, ",")
+}
+
+func (n *Namespaces) Set(v string) error {
+    ns, err := ParseNamespace(v)
+    if err != nil {return err}
+    *n = append(*n, ns)
+    return nil
+}
+
+// namespaces puts default namespace in front of configured ones and checks they don't collide
+func (s *CacheServer) namespaces() ([]*Namespace, error) {
+    spaces := []*Namespace{{Name: defaultNamespace, Port: s.Port, Path: s.Path, DiskCap: s.DiskCap, Storage: s.Storage, Upstream: s.Upstream, Tokens: s.Tokens}}
+    names := map[string]bool{defaultNamespace: true}
+    ports := map[int]string{s.Port: defaultNamespace}
+    for _, ns := range s.Namespaces {
+        if err := validNamespace(ns.Name); err != nil {return nil, err}
+        if names[ns.Name] {return nil, fmt.Errorf("namespace %q duplicated", ns.Name)}
+        if name, ok := ports[ns.Port]; ok {return nil, fmt.Errorf("namespace %q port %d used by %q", ns.Name, ns.Port, name)}
+        names[ns.Name] = true
+        ports[ns.Port] = ns.Name
+        if ns.Path == "" { ns.Path = path.Join(s.Path, ns.Name) }
+        spaces = append(spaces, ns)
+    }
+    return spaces, nil
+}
+
+// fallback is used by Handle before Listen sets up namespaces, default namespace is opened on first use
+func (s *CacheServer) fallback() *Namespace {
+    s.Lock()
+    defer s.Unlock()
+    if len(s.spaces) == 0 {
+        ns := &Namespace{Name: defaultNamespace, Port: s.Port, Path: s.Path, DiskCap: s.DiskCap, Storage: s.Storage, Upstream: s.Upstream, Tokens: s.Tokens}
+        if !s.DryRun {
+            ns.open(s.TempAge, s.background().Done())
+            s.forwardFor(ns)
+        }
+        s.spaces = []*Namespace{ns}
+    }
+    return s.spaces[0]
+}
+
+// probe tells whether ns is private to readiness self-check, which stays out of metrics and logs
+func (ns *Namespace) probe() bool { return ns.Name == probeNamespace }
+
+// open sets up storage and disk cache of ns, its background goroutines run until done is closed
+func (ns *Namespace) open(age time.Duration, done <-chan struct{}) {
+    if ns.Storage == nil { ns.Storage = NewFileStorage(ns.Path) }
+    ns.store = ns.Storage
+    if t, ok := ns.store.(interface{ tempDir() string }); ok { ns.temp = t.tempDir() }
+    if ns.temp != "" {
+        ns.recoverTemp()
+        if age > 0 { go ns.sweeper(age, done) }
+    }
+    ns.disk = newDiskCache(ns.Name, ns.store, ns.DiskCap)
+    if t, ok := ns.store.(*TieredStorage); ok && t.OnFill == nil {
+        t.OnFill = func(key string, size int64) {
+            if !strings.HasSuffix(key, checksumExt) { ns.disk.fill(key, size) }
+        }
+    }
+    ns.disk.evicted = func(key string) {
+        if e, t, ok := parseKey(key); ok { mcache.core.delete(ns.uuid(e, t)) }
+    }
+    go ns.disk.scan()
+    go ns.disk.janitor(time.Minute, done)
+    logger.Info("namespace", zap.String("name", ns.Name), zap.Int("port", ns.Port), zap.String("path", ns.Path), zap.Int64("disk-cap", ns.DiskCap))
+}
+
+// uuid keys memory cache, which is shared by all namespaces, artifacts of readiness self-check get none to stay out of it
+func (ns *Namespace) uuid(e Entity, t RequestType) string {
+    if ns.probe() {return ""}
+    return ns.Name + "/" + e.guid + e.hash + string(t)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+    "bytes"
+    "encoding/hex"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// namespaced sets up namespaces of harness server as Listen does, connections of each namespace are served over net.Pipe
+func (h *harness) namespaced() map[string]*harness {
+    s := h.server
+    spaces, err := s.namespaces()
+    if err != nil {h.t.Fatal(err)}
+    s.Lock()
+    s.spaces = spaces
+    s.listeners = []net.Listener{}
+    for _, ns := range spaces {
+        ns.open(s.TempAge, s.background().Done())
+        s.forwardFor(ns)
+    }
+    s.Unlock()
+    h.t.Cleanup(func() { s.stop() })
+    harnesses := map[string]*harness{}
+    for _, ns := range spaces {
+        ns := ns
+        harnesses[ns.Name] = &harness{t: h.t, server: s, dial: func() net.Conn {
+            c, p := net.Pipe()
+            s.group.Add(1)
+            go s.serve(p, ns)
+            return c
+        }}
+    }
+    return harnesses
+}
+
+// artifactPath is where FileStorage rooted at root keeps artifact id
+func artifactPath(root string, id string, t RequestType) string {
+    guid, hash := hex.EncodeToString([]byte(id[:16])), hex.EncodeToString([]byte(id[16:]))
+    return filepath.Join(root, guid[:2], artifactKey(guid, hash, t))
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.CacheCap = 1 << 20
+        s.Namespaces = Namespaces{{Name: "team-a", Port: 1}}
+    })
+    spaces := h.namespaced()
+    var log bytes.Buffer
+    home, team := spaces[defaultNamespace].connect(&log), spaces["team-a"].connect(&log)
+    mine, theirs := testEntity(0x91), testEntity(0x92)
+    home.send("ts", mine, putCmd(RequestTypeBin, testBody(RequestTypeBin, mine)), "te")
+    team.send("ts", theirs, putCmd(RequestTypeBin, testBody(RequestTypeBin, theirs)), "te")
+    for i := 0; i < 2; i++ { /* the second round is served from memory cache */
+        home.send(getCmd(RequestTypeBin, mine), getCmd(RequestTypeBin, theirs))
+        home.expect(hit(RequestTypeBin, mine, testBody(RequestTypeBin, mine)), miss(RequestTypeBin, theirs))
+        team.send(getCmd(RequestTypeBin, mine), getCmd(RequestTypeBin, theirs))
+        team.expect(miss(RequestTypeBin, mine), hit(RequestTypeBin, theirs, testBody(RequestTypeBin, theirs)))
+    }
+
+    /* namespace directories live under that of default namespace */
+    root := h.server.Path
+    for _, c := range []struct{ path string; exists bool }{
+        {artifactPath(root, mine, RequestTypeBin), true},
+        {artifactPath(filepath.Join(root, "team-a"), mine, RequestTypeBin), false},
+        {artifactPath(filepath.Join(root, "team-a"), theirs, RequestTypeBin), true},
+        {artifactPath(root, theirs, RequestTypeBin), false},
+    } {
+        if _, err := os.Stat(c.path); (err == nil) != c.exists { t.Errorf("%s exists %v: %v", c.path, c.exists, err) }
+    }
+    home.send("qq")
+    home.closed()
+    team.send("qq")
+    team.closed()
+}
+
+func TestNamespaceQuota(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.DiskCap = 1 << 20
+        s.Namespaces = Namespaces{{Name: "team-a", Port: 1, DiskCap: 2500}}
+    })
+    spaces := h.namespaced()
+    var log bytes.Buffer
+    body := strings.Repeat("x", 1000)
+    var ids []string
+    for _, name := range []string{defaultNamespace, "team-a"} {
+        s := spaces[name].connect(&log)
+        for _, b := range []byte{0xa1, 0xa2, 0xa3} {
+            id := testEntity(b)
+            s.send("ts", id, putCmd(RequestTypeBin, body), "te")
+            s.send(getCmd(RequestTypeBin, id)) /* in order of use */
+            s.expect(hit(RequestTypeBin, id, body))
+            if name == defaultNamespace { ids = append(ids, id) }
+        }
+        s.send("qq")
+        s.closed()
+    }
+    h.settle()
+
+    /* team-a is evicted down to 90% of its quota, default namespace is far below its own */
+    team, home := h.server.spaces[1].disk, h.server.spaces[0].disk
+    want := diskKeys(home)[:strings.LastIndexByte(diskKeys(home), ',')] /* least recently used one is gone */
+    for deadline := time.Now().Add(5 * time.Second); diskKeys(team) != want; time.Sleep(time.Millisecond) {
+        if time.Now().After(deadline) { t.Fatalf("team-a not evicted: %s", diskKeys(team)) }
+    }
+    if entities, _ := home.entries(0, -1); len(entities) != 3 { t.Fatalf("default namespace evicted: %s", diskKeys(home)) }
+    s := spaces[defaultNamespace].connect(&log)
+    u := spaces["team-a"].connect(&log)
+    s.send(getCmd(RequestTypeBin, ids[0]))
+    s.expect(hit(RequestTypeBin, ids[0], body))
+    u.send(getCmd(RequestTypeBin, ids[0]), getCmd(RequestTypeBin, ids[1]))
+    u.expect(miss(RequestTypeBin, ids[0]), hit(RequestTypeBin, ids[1], body))
+    s.send("qq")
+    s.closed()
+    u.send("qq")
+    u.closed()
+}
+
+func TestNamespaceTokens(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.Tokens = map[string]Role{"home-token": RoleWrite}
+        s.Namespaces = Namespaces{{Name: "team-a", Port: 1, Tokens: map[string]Role{"team-token": RoleWrite}}}
+    })
+    spaces := h.namespaced()
+    var log bytes.Buffer
+    for name, tokens := range map[string][2]string{defaultNamespace: {"home-token", "team-token"}, "team-a": {"team-token", "home-token"}} {
+        s := spaces[name].connect(&log)
+        s.send(authCmd(tokens[1]))
+        s.expect("-a")
+        s.closed()
+
+        s = spaces[name].connect(&log)
+        s.send(authCmd(tokens[0]))
+        s.expect("+a")
+        id := testEntity(0xb1)
+        s.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+        s.send(getCmd(RequestTypeBin, id))
+        s.expect(hit(RequestTypeBin, id, testBody(RequestTypeBin, id)))
+        s.send("qq")
+        s.closed()
+    }
+}
@@ -0,0 +1,61 @@
+package server
+
+import "sync"
+
+// buffer size classes double from poolMin up to poolMax, which covers artifacts held by memory cache
+const (
+    poolMin = 1 << 10
+    poolMax = 2 << 20
+)
+
+// bufferPool recycles buffers of one size class
+type bufferPool struct {
+    size   int
+    class  string
+    pool   sync.Pool
+    gets   *sample
+    puts   *sample
+    allocs *sample
+}
+
+var pools []*bufferPool
+
+func init() {
+    for size := poolMin; size <= poolMax; size <<= 1 {
+        p := &bufferPool{size: size}
+        class := ByteSize(size)
+        p.class = class.String()
+        p.gets, p.puts, p.allocs = metrics.poolGets.with(p.class), metrics.poolPuts.with(p.class), metrics.poolAllocs.with(p.class)
+        p.pool.New = func() interface{} {
+            p.allocs.add(1)
+            b := make([]byte, p.size)
+            return &b
+        }
+        pools = append(pools, p)
+    }
+}
+
+func poolOf(size int) *bufferPool {
+    for _, p := range pools {
+        if size <= p.size {return p}
+    }
+    return nil
+}
+
+// getBuffer returns a buffer of len size from the smallest class holding it, larger ones are allocated as is
+func getBuffer(size int) []byte {
+    p := poolOf(size)
+    if p == nil {return make([]byte, size)}
+    p.gets.add(1)
+    b := *p.pool.Get().(*[]byte)
+    return b[:size]
+}
+
+// putBuffer recycles a buffer of getBuffer, which must not be referenced any more
+func putBuffer(b []byte) {
+    p := poolOf(cap(b))
+    if p == nil || p.size != cap(b) {return} /* not from pool, e.g. grown by bytes.Buffer */
+    p.puts.add(1)
+    b = b[:cap(b)]
+    p.pool.Put(&b)
+}
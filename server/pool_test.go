@@ -0,0 +1,23 @@
+package server
+
+import "testing"
+
+func TestBufferPool(t *testing.T) {
+    for _, c := range []struct{ size, class int }{{1, poolMin}, {poolMin, poolMin}, {poolMin + 1, poolMin << 1}, {16 << 10, 16 << 10}, {poolMax, poolMax}} {
+        b := getBuffer(c.size)
+        if len(b) != c.size || cap(b) != c.class { t.Fatalf("getBuffer(%d) len=%d cap=%d, want cap %d", c.size, len(b), cap(b), c.class) }
+        putBuffer(b)
+    }
+
+    b := getBuffer(poolMax + 1)
+    if len(b) != poolMax + 1 || cap(b) != poolMax + 1 { t.Fatalf("oversized len=%d cap=%d", len(b), cap(b)) }
+
+    p := poolOf(4 << 10)
+    puts := p.puts.get()
+    putBuffer(make([]byte, 3 << 10)) /* not a class size */
+    putBuffer(make([]byte, 0, 4 << 10))
+    if n := p.puts.get() - puts; n != 1 { t.Fatalf("puts %d, want 1", n) }
+    gets := p.gets.get()
+    if b := getBuffer(4 << 10); len(b) != 4 << 10 { t.Fatalf("len %d", len(b)) }
+    if n := p.gets.get() - gets; n != 1 { t.Fatalf("gets %d, want 1", n) }
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+    "go.uber.org/zap"
+)
+
+const (
+    malformedVersion     = "version"     // handshake isn't a hex version
+    malformedCommand     = "command"     // unknown command
+    malformedType        = "type"        // artifact type isn't one of a/i/r
+    malformedSize        = "size"        // put size isn't a hex int64
+    malformedTransaction = "transaction" // put before any transaction is started
+    malformedPanic       = "panic"       // connection goroutine recovered from a panic
+)
+
+func (r RequestType) valid() bool { return r == RequestTypeBin || r == RequestTypeInf || r == RequestTypeRes }
+
+// malformed counts a protocol violation, callers drop the connection as the stream can't be resynced
+func (c *connection) malformed(reason string, fields ...zap.Field) {
+    fields = append([]zap.Field{zap.String("addr", c.RemoteAddr().String()), zap.String("reason", reason)}, fields...)
+    logger.Warn("malformed input", fields...)
+    metrics.malformed.with(c.ns.Name, reason).add(1)
+}
+
+// recovered confines a panic to its connection, it's deferred at the top of connection goroutines
+func (c *connection) recovered() {
+    if r := recover(); r != nil {
+        logger.Error("connection panic", zap.String("addr", c.RemoteAddr().String()), zap.Any("panic", r), zap.Stack("stack"))
+        metrics.malformed.with(c.ns.Name, malformedPanic).add(1)
+        c.Close()
+    }
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+    "bytes"
+    "encoding/hex"
+    "io"
+    "io/ioutil"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+var testID = bytes.Repeat([]byte{0x5a}, 32)
+
+func stream(parts ...string) []byte { return []byte(strings.Join(parts, "")) }
+
+// drive writes data to Handle as a client and waits for both connection goroutines to finish
+func drive(t *testing.T, s *CacheServer, data []byte) {
+    c, p := net.Pipe()
+    done := make(chan struct{})
+    go func() {
+        s.Handle(p)
+        s.group.Wait()
+        close(done)
+    }()
+    go io.Copy(ioutil.Discard, c)
+    c.SetDeadline(time.Now().Add(time.Second))
+    c.Write(data)
+    c.Close()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second): t.Fatalf("connection stuck on %q", data)
+    }
+}
+
+func TestMalformed(t *testing.T) {
+    s := &CacheServer{Storage: NewMemoryStorage()}
+    id := string(testID)
+    cases := []struct {
+        reason string
+        data   []byte
+    }{
+        {malformedVersion, stream("zz")},
+        {malformedCommand, stream("fe", "xx")},
+        {malformedCommand, stream("fe", "tx")},
+        {malformedCommand, stream("fe", "ax")},
+        {malformedType, stream("fe", "gz", id)},
+        {malformedType, stream("fe", "ts", id, "pz")},
+        {malformedTransaction, stream("fe", "pa", "0000000000000004", "abcd")},
+        {malformedSize, stream("fe", "ts", id, "pa", "ffffffffffffffff")},
+        {malformedSize, stream("fe", "ts", id, "pa", "-000000000000004")},
+    }
+    for _, c := range cases {
+        before := metrics.malformed.with(defaultNamespace, c.reason).get()
+        drive(t, s, c.data)
+        if n := metrics.malformed.with(defaultNamespace, c.reason).get(); n != before + 1 {
+            t.Errorf("%q not counted as %s", c.data, c.reason)
+        }
+    }
+    if n := metrics.malformed.with(defaultNamespace, malformedPanic).get(); n != 0 { t.Fatalf("%d panics recovered", n) }
+
+    /* a well-formed session still works on the same server */
+    drive(t, s, stream("fe", "ts", id, "pa", "0000000000000004", "abcd", "te"))
+    data, err := s.fallback().store.Get(artifactKey(hex.EncodeToString(testID[:16]), hex.EncodeToString(testID[16:]), RequestTypeBin))
+    if err != nil {t.Fatal(err)}
+    data.Close()
+}
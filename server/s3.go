@@ -0,0 +1,399 @@
+package server
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// S3Storage keeps artifacts in an S3 compatible bucket addressed in path style, i.e. Endpoint/Bucket/Prefix<key>
+type S3Storage struct {
+    Endpoint  string
+    Bucket    string
+    Prefix    string
+    Region    string
+    AccessKey string
+    SecretKey string
+    // PartSize is the buffered size of each multipart upload part, smaller uploads go in a single PUT.
+    // S3 rejects parts but the last one below S3MinPartSize.
+    PartSize  int64
+    // Timeout bounds connecting, waiting for response headers and every read of a response body, 0 disables it
+    Timeout   time.Duration
+    // Client defaults to one bounded by Timeout
+    Client    *http.Client
+}
+
+const (
+    S3DefaultPartSize = 8 << 20
+    S3MinPartSize     = 5 << 20
+    s3DefaultTimeout  = 30 * time.Second
+)
+
+// NewS3Storage checks partSize is no less than S3MinPartSize, S3 would reject parts of every multipart upload otherwise
+func NewS3Storage(endpoint string, bucket string, region string, access string, secret string, partSize int64) (*S3Storage, error) {
+    if partSize < S3MinPartSize {return nil, fmt.Errorf("s3 part size %d below minimum part size of S3 %d", partSize, S3MinPartSize)}
+    return &S3Storage{Endpoint: strings.TrimRight(endpoint, "/"), Bucket: bucket, Region: region, AccessKey: access, SecretKey: secret, PartSize: partSize, Timeout: s3DefaultTimeout}, nil
+}
+
+// s3Clients shares connections among storages of the same timeout, e.g. those of every namespace
+var s3Clients sync.Map
+
+func (s *S3Storage) httpClient() *http.Client {
+    if s.Client != nil {return s.Client}
+    if c, ok := s3Clients.Load(s.Timeout); ok {return c.(*http.Client)}
+    t := http.DefaultTransport.(*http.Transport).Clone()
+    if s.Timeout > 0 {
+        t.DialContext = (&net.Dialer{Timeout: s.Timeout, KeepAlive: 30 * time.Second}).DialContext
+        t.TLSHandshakeTimeout = s.Timeout
+        t.ResponseHeaderTimeout = s.Timeout
+    }
+    c, _ := s3Clients.LoadOrStore(s.Timeout, &http.Client{Transport: t})
+    return c.(*http.Client)
+}
+
+// idleBody cancels its request once no read completes within timeout, a stalled body fails instead of hanging
+type idleBody struct {
+    io.ReadCloser
+    timer   *time.Timer /* nil without timeout */
+    timeout time.Duration
+    cancel  context.CancelFunc
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+    if b.timer != nil { b.timer.Reset(b.timeout) }
+    return b.ReadCloser.Read(p)
+}
+
+func (b *idleBody) Close() error {
+    if b.timer != nil { b.timer.Stop() }
+    b.cancel()
+    return b.ReadCloser.Close()
+}
+
+var emptySha256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+func (s *S3Storage) request(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+    u, err := url.Parse(s.Endpoint)
+    if err != nil {return nil, err}
+    u.Path = u.Path + "/" + s.Bucket
+    if key != "" { u.Path += "/" + s.Prefix + key }
+    u.RawPath = uriEncode(u.Path, false)
+    u.RawQuery = canonicalQuery(query)
+    var r io.Reader
+    if body != nil { r = bytes.NewReader(body) }
+    ctx, cancel := context.WithCancel(context.Background())
+    req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+    if err != nil {
+        cancel()
+        return nil, err
+    }
+    for k, v := range header { req.Header[k] = v }
+    payload := emptySha256
+    if body != nil {
+        sum := sha256.Sum256(body)
+        payload = hex.EncodeToString(sum[:])
+    }
+    req.Header.Set("X-Amz-Content-Sha256", payload)
+    signV4(req, payload, s.AccessKey, s.SecretKey, s.Region, "s3", time.Now())
+    rsp, err := s.httpClient().Do(req)
+    if err != nil {
+        cancel()
+        return nil, err
+    }
+    idle := &idleBody{ReadCloser: rsp.Body, timeout: s.Timeout, cancel: cancel}
+    if s.Timeout > 0 { idle.timer = time.AfterFunc(s.Timeout, cancel) }
+    rsp.Body = idle
+    return rsp, nil
+}
+
+// do sends a request and turns non 2xx responses into errors, 404 becomes ErrMiss
+func (s *S3Storage) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+    rsp, err := s.request(method, key, query, header, body)
+    if err != nil {return nil, err}
+    if rsp.StatusCode/100 == 2 {return rsp, nil}
+    defer rsp.Body.Close()
+    if rsp.StatusCode == http.StatusNotFound {return nil, ErrMiss}
+    b, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512))
+    return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, rsp.Status, strings.TrimSpace(string(b)))
+}
+
+// s3Object streams an object body, reads broken midway are resumed with ranged requests
+type s3Object struct {
+    s       *S3Storage
+    key     string
+    body    io.ReadCloser
+    size    int64
+    read    int64
+    retries int
+}
+
+func (o *s3Object) Size() int64 { return o.size }
+
+func (o *s3Object) Read(p []byte) (int, error) {
+    for {
+        n, err := o.body.Read(p)
+        o.read += int64(n)
+        if err == nil || err == io.EOF && o.read >= o.size {return n, err}
+        if o.read >= o.size || o.retries >= 3 {
+            if err == io.EOF { err = io.ErrUnexpectedEOF }
+            return n, err
+        }
+        o.retries++
+        o.body.Close()
+        h := http.Header{}
+        h.Set("Range", "bytes=" + strconv.FormatInt(o.read, 10) + "-")
+        rsp, e := o.s.do(http.MethodGet, o.key, nil, h, nil)
+        if e != nil {
+            o.body = ioutil.NopCloser(bytes.NewReader(nil))
+            return n, e
+        }
+        if rsp.StatusCode != http.StatusPartialContent {
+            rsp.Body.Close()
+            o.body = ioutil.NopCloser(bytes.NewReader(nil))
+            return n, fmt.Errorf("s3 resume %s: %s", o.key, rsp.Status)
+        }
+        o.body = rsp.Body
+        if n > 0 {return n, nil}
+    }
+}
+
+func (o *s3Object) Close() error { return o.body.Close() }
+
+func (s *S3Storage) Get(key string) (Object, error) {
+    rsp, err := s.do(http.MethodGet, key, nil, nil, nil)
+    if err != nil {return nil, err}
+    return &s3Object{s: s, key: key, body: rsp.Body, size: rsp.ContentLength}, nil
+}
+
+func (s *S3Storage) Stat(key string) (Info, error) {
+    rsp, err := s.do(http.MethodHead, key, nil, nil, nil)
+    if err != nil {return Info{}, err}
+    rsp.Body.Close()
+    mtime, _ := http.ParseTime(rsp.Header.Get("Last-Modified"))
+    return Info{Key: key, Size: rsp.ContentLength, Mtime: mtime}, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+    rsp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+    if err != nil {return err}
+    return rsp.Body.Close()
+}
+
+type s3ListResult struct {
+    Contents []struct {
+        Key          string
+        Size         int64
+        LastModified time.Time
+    }
+    IsTruncated           bool
+    NextContinuationToken string
+}
+
+func (s *S3Storage) Walk(fn func(info Info) error) error {
+    token := ""
+    for {
+        q := url.Values{"list-type": {"2"}}
+        if s.Prefix != "" { q.Set("prefix", s.Prefix) }
+        if token != "" { q.Set("continuation-token", token) }
+        rsp, err := s.do(http.MethodGet, "", q, nil, nil)
+        if err != nil {return err}
+        var result s3ListResult
+        err = xml.NewDecoder(rsp.Body).Decode(&result)
+        rsp.Body.Close()
+        if err != nil {return err}
+        for _, c := range result.Contents {
+            if err := fn(Info{Key: strings.TrimPrefix(c.Key, s.Prefix), Size: c.Size, Mtime: c.LastModified}); err != nil {return err}
+        }
+        if !result.IsTruncated || result.NextContinuationToken == "" {return nil}
+        token = result.NextContinuationToken
+    }
+}
+
+type s3Part struct {
+    PartNumber int
+    ETag       string
+}
+
+// s3Upload buffers one part in memory, it turns into a multipart upload once the body exceeds PartSize
+type s3Upload struct {
+    s     *S3Storage
+    key   string
+    b     bytes.Buffer
+    id    string
+    parts []s3Part
+    done  bool
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+    if u.done {return 0, errors.New("upload already finished")}
+    size := u.s.PartSize
+    if size <= 0 { size = S3DefaultPartSize }
+    written := 0
+    for len(p) > 0 {
+        n := int(size) - u.b.Len()
+        if n > len(p) { n = len(p) }
+        u.b.Write(p[:n])
+        p = p[n:]
+        written += n
+        if int64(u.b.Len()) >= size {
+            if err := u.flush(); err != nil {return written, err}
+        }
+    }
+    return written, nil
+}
+
+func (u *s3Upload) flush() error {
+    if u.id == "" {
+        rsp, err := u.s.do(http.MethodPost, u.key, url.Values{"uploads": {""}}, nil, []byte{})
+        if err != nil {return err}
+        var result struct{ UploadId string }
+        err = xml.NewDecoder(rsp.Body).Decode(&result)
+        rsp.Body.Close()
+        if err != nil {return err}
+        if result.UploadId == "" {return fmt.Errorf("s3 initiate %s: empty upload id", u.key)}
+        u.id = result.UploadId
+    }
+    num := len(u.parts) + 1
+    rsp, err := u.s.do(http.MethodPut, u.key, url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {u.id}}, nil, u.b.Bytes())
+    if err != nil {return err}
+    rsp.Body.Close()
+    u.parts = append(u.parts, s3Part{PartNumber: num, ETag: rsp.Header.Get("ETag")})
+    u.b.Reset()
+    return nil
+}
+
+func (u *s3Upload) Commit() error {
+    if u.done {return errors.New("upload already finished")}
+    u.done = true
+    if u.id == "" {
+        rsp, err := u.s.do(http.MethodPut, u.key, nil, nil, u.b.Bytes())
+        if err != nil {return err}
+        return rsp.Body.Close()
+    }
+    if u.b.Len() > 0 {
+        if err := u.flush(); err != nil {
+            u.abort()
+            return err
+        }
+    }
+    body, err := xml.Marshal(struct {
+        XMLName xml.Name `xml:"CompleteMultipartUpload"`
+        Parts   []s3Part `xml:"Part"`
+    }{Parts: u.parts})
+    if err != nil {
+        u.abort()
+        return err
+    }
+    rsp, err := u.s.do(http.MethodPost, u.key, url.Values{"uploadId": {u.id}}, nil, body)
+    if err != nil {
+        u.abort()
+        return err
+    }
+    defer rsp.Body.Close()
+    // completion may fail after 200 OK with an error document in body
+    b, err := ioutil.ReadAll(rsp.Body)
+    if err != nil {return err}
+    if bytes.Contains(b, []byte("<Error>")) {
+        u.abort() /* parts are kept and billed until aborted */
+        return fmt.Errorf("s3 complete %s: %s", u.key, strings.TrimSpace(string(b)))
+    }
+    return nil
+}
+
+func (u *s3Upload) abort() error {
+    if u.id == "" {return nil}
+    rsp, err := u.s.do(http.MethodDelete, u.key, url.Values{"uploadId": {u.id}}, nil, nil)
+    if err != nil {return err}
+    return rsp.Body.Close()
+}
+
+func (u *s3Upload) Abort() error {
+    if u.done {return nil}
+    u.done = true
+    u.b.Reset()
+    return u.abort()
+}
+
+func (s *S3Storage) Put(key string) (Upload, error) {
+    return &s3Upload{s: s, key: key}, nil
+}
+
+// uriEncode escapes everything but unreserved characters as AWS Signature Version 4 requires
+func uriEncode(s string, slash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+            b.WriteByte(c)
+        } else { fmt.Fprintf(&b, "%%%02X", c) }
+    }
+    return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+    var pairs []string
+    for k, values := range query {
+        for _, v := range values { pairs = append(pairs, uriEncode(k, true) + "=" + uriEncode(v, true)) }
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(data))
+    return h.Sum(nil)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header covering host and all headers already set
+func signV4(req *http.Request, payload string, access string, secret string, region string, service string, now time.Time) {
+    ts := now.UTC().Format("20060102T150405Z")
+    date := ts[:8]
+    req.Header.Set("X-Amz-Date", ts)
+    host := req.Host
+    if host == "" { host = req.URL.Host }
+
+    headers := map[string]string{"host": host}
+    for k, v := range req.Header {
+        k = strings.ToLower(k)
+        if k == "authorization" {continue}
+        values := make([]string, len(v))
+        for i := range v { values[i] = strings.Join(strings.Fields(v[i]), " ") }
+        headers[k] = strings.Join(values, ",")
+    }
+    names := make([]string, 0, len(headers))
+    for k := range headers { names = append(names, k) }
+    sort.Strings(names)
+    var canonical strings.Builder
+    canonical.WriteString(req.Method + "\n")
+    canonical.WriteString(uriEncode(req.URL.Path, false) + "\n")
+    canonical.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+    for _, k := range names { canonical.WriteString(k + ":" + headers[k] + "\n") }
+    signed := strings.Join(names, ";")
+    canonical.WriteString("\n" + signed + "\n" + payload)
+
+    scope := date + "/" + region + "/" + service + "/aws4_request"
+    sum := sha256.Sum256([]byte(canonical.String()))
+    text := "AWS4-HMAC-SHA256\n" + ts + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+    key := hmacSha256([]byte("AWS4" + secret), date)
+    key = hmacSha256(key, region)
+    key = hmacSha256(key, service)
+    key = hmacSha256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSha256(key, text))
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + access + "/" + scope + ", SignedHeaders=" + signed + ", Signature=" + signature)
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "io"
+    "fmt"
+    "io/ioutil"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const (
+    testAccess = "AKIDEXAMPLE"
+    testSecret = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 is a minimal in-process S3 serving one bucket in path style
+type fakeS3 struct {
+    t       *testing.T
+    bucket  string
+    objects map[string][]byte
+    uploads map[string]map[int][]byte
+    cut     map[string]bool // keys whose next full GET breaks midway
+    parts   int
+    sync.Mutex
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+    f := &fakeS3{t: t, bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}, cut: map[string]bool{}}
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+    return f, srv
+}
+
+func (f *fakeS3) authorized(r *http.Request, body []byte) bool {
+    auth := r.Header.Get("Authorization")
+    i := strings.Index(auth, "SignedHeaders=")
+    j := strings.Index(auth, ", Signature=")
+    if i < 0 || j < i {return false}
+    sum := sha256.Sum256(body)
+    payload := r.Header.Get("X-Amz-Content-Sha256")
+    if payload != hex.EncodeToString(sum[:]) {return false}
+    ts, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+    if err != nil {return false}
+    req, _ := http.NewRequest(r.Method, "http://" + r.Host + r.URL.RequestURI(), nil)
+    for _, k := range strings.Split(auth[i+len("SignedHeaders="):j], ";") {
+        if k != "host" && k != "x-amz-date" { req.Header.Set(k, r.Header.Get(k)) }
+    }
+    signV4(req, payload, testAccess, testSecret, "us-east-1", "s3", ts)
+    return req.Header.Get("Authorization") == auth
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    if !f.authorized(r, body) {
+        http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+        return
+    }
+    f.Lock()
+    defer f.Unlock()
+    path := strings.TrimPrefix(r.URL.Path, "/" + f.bucket)
+    q := r.URL.Query()
+    if path == "" || path == "/" {
+        f.list(w, q)
+        return
+    }
+    key := path[1:]
+    switch {
+    case r.Method == http.MethodPost && q["uploads"] != nil:
+        id := strconv.Itoa(len(f.uploads) + 1)
+        f.uploads[id] = map[int][]byte{}
+        fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+    case r.Method == http.MethodPut && q.Get("uploadId") != "":
+        parts, ok := f.uploads[q.Get("uploadId")]
+        if !ok {http.NotFound(w, r);return}
+        num, _ := strconv.Atoi(q.Get("partNumber"))
+        parts[num] = body
+        f.parts++
+        w.Header().Set("ETag", strconv.Quote(strconv.Itoa(num)))
+    case r.Method == http.MethodPost && q.Get("uploadId") != "":
+        parts, ok := f.uploads[q.Get("uploadId")]
+        if !ok {http.NotFound(w, r);return}
+        var complete struct{ Part []s3Part }
+        if err := xml.Unmarshal(body, &complete); err != nil {http.Error(w, err.Error(), http.StatusBadRequest);return}
+        var data []byte
+        for i, p := range complete.Part {
+            if p.PartNumber != i + 1 || p.ETag != strconv.Quote(strconv.Itoa(i + 1)) {http.Error(w, "bad part", http.StatusBadRequest);return}
+            data = append(data, parts[p.PartNumber]...)
+        }
+        delete(f.uploads, q.Get("uploadId"))
+        f.objects[key] = data
+        fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+    case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+        delete(f.uploads, q.Get("uploadId"))
+        w.WriteHeader(http.StatusNoContent)
+    case r.Method == http.MethodPut:
+        f.objects[key] = body
+    case r.Method == http.MethodDelete:
+        delete(f.objects, key)
+        w.WriteHeader(http.StatusNoContent)
+    case r.Method == http.MethodGet || r.Method == http.MethodHead:
+        data, ok := f.objects[key]
+        if !ok {http.NotFound(w, r);return}
+        w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+        if rg := r.Header.Get("Range"); rg != "" {
+            offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rg, "bytes="), "-"))
+            w.Header().Set("Content-Length", strconv.Itoa(len(data) - offset))
+            w.WriteHeader(http.StatusPartialContent)
+            w.Write(data[offset:])
+            return
+        }
+        w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+        if r.Method == http.MethodHead {return}
+        if f.cut[key] {
+            delete(f.cut, key)
+            w.Write(data[:len(data)/2])
+            return
+        }
+        w.Write(data)
+    default:
+        http.Error(w, "unsupported", http.StatusBadRequest)
+    }
+}
+
+// list pages two keys at a time to exercise continuation
+func (f *fakeS3) list(w http.ResponseWriter, q map[string][]string) {
+    prefix, token := "", ""
+    if v := q["prefix"]; len(v) > 0 { prefix = v[0] }
+    if v := q["continuation-token"]; len(v) > 0 { token = v[0] }
+    var keys []string
+    for k := range f.objects {
+        if strings.HasPrefix(k, prefix) && k > token { keys = append(keys, k) }
+    }
+    sort.Strings(keys)
+    truncated := len(keys) > 2
+    if truncated { keys = keys[:2] }
+    fmt.Fprint(w, "<ListBucketResult>")
+    for _, k := range keys {
+        fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>", k, len(f.objects[k]), time.Now().UTC().Format(time.RFC3339))
+    }
+    fmt.Fprintf(w, "<IsTruncated>%v</IsTruncated>", truncated)
+    if truncated { fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1]) }
+    fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func put(t *testing.T, store Storage, key string, data []byte) {
+    u, err := store.Put(key)
+    if err != nil {t.Fatal(err)}
+    // odd sized writes straddle part boundaries
+    for b := data; len(b) > 0; {
+        n := 1000
+        if n > len(b) { n = len(b) }
+        if _, err := u.Write(b[:n]); err != nil {t.Fatal(err)}
+        b = b[n:]
+    }
+    if err := u.Commit(); err != nil {t.Fatal(err)}
+}
+
+func get(t *testing.T, store Storage, key string) []byte {
+    o, err := store.Get(key)
+    if err != nil {t.Fatal(err)}
+    defer o.Close()
+    b, err := ioutil.ReadAll(o)
+    if err != nil {t.Fatal(err)}
+    if int64(len(b)) != o.Size() {t.Fatalf("%s size %d != %d", key, len(b), o.Size())}
+    return b
+}
+
+// TestSignV4 checks against the GET ListUsers example of AWS Signature Version 4 documentation
+func newTestS3(t *testing.T, endpoint string, secret string) *S3Storage {
+    s, err := NewS3Storage(endpoint, "cache", "us-east-1", testAccess, secret, S3DefaultPartSize)
+    if err != nil {t.Fatal(err)}
+    return s
+}
+
+func TestSignV4(t *testing.T) {
+    req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+    signV4(req, emptySha256, testAccess, testSecret, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+    expect := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+    if auth := req.Header.Get("Authorization"); auth != expect {t.Fatalf("%s != %s", auth, expect)}
+}
+
+func TestS3PartSize(t *testing.T) {
+    for _, size := range []int64{0, 64 << 10, S3MinPartSize - 1} {
+        if _, err := NewS3Storage("http://s3", "cache", "us-east-1", testAccess, testSecret, size); err == nil {t.Errorf("part size %d accepted", size)}
+    }
+    if s, err := NewS3Storage("http://s3/", "cache", "us-east-1", testAccess, testSecret, S3MinPartSize); err != nil || s.PartSize != S3MinPartSize || s.Endpoint != "http://s3" {t.Fatalf("%+v %v", s, err)}
+}
+
+func TestS3Storage(t *testing.T) {
+    fake, srv := newFakeS3(t, "cache")
+    s := newTestS3(t, srv.URL, testSecret)
+    s.Prefix = "ci/"
+    s.PartSize = 64 << 10 /* fake S3 takes parts below S3MinPartSize */
+
+    small := []byte("hello")
+    large := make([]byte, 200 << 10 + 123)
+    rand.Read(large)
+    put(t, s, "a-b.bin", small)
+    put(t, s, "c-d.bin", large)
+    put(t, s, "e-f.info", nil)
+    if fake.parts != 4 {t.Fatalf("multipart parts %d != 4", fake.parts)}
+    if len(fake.uploads) != 0 {t.Fatalf("unfinished uploads %d", len(fake.uploads))}
+    if _, ok := fake.objects["ci/c-d.bin"]; !ok {t.Fatal("prefix not applied")}
+
+    if b := get(t, s, "a-b.bin"); !bytes.Equal(b, small) {t.Fatal("small not match")}
+    if b := get(t, s, "c-d.bin"); !bytes.Equal(b, large) {t.Fatal("large not match")}
+    fake.cut["ci/c-d.bin"] = true
+    if b := get(t, s, "c-d.bin"); !bytes.Equal(b, large) {t.Fatal("resumed not match")}
+    if _, err := s.Get("x-y.bin"); err != ErrMiss {t.Fatalf("miss: %v", err)}
+
+    if info, err := s.Stat("c-d.bin"); err != nil || info.Size != int64(len(large)) {t.Fatalf("stat %+v %v", info, err)}
+    if _, err := s.Stat("x-y.bin"); err != ErrMiss {t.Fatalf("stat miss: %v", err)}
+
+    var keys []string
+    if err := s.Walk(func(info Info) error { keys = append(keys, info.Key); return nil }); err != nil {t.Fatal(err)}
+    sort.Strings(keys)
+    if strings.Join(keys, ",") != "a-b.bin,c-d.bin,e-f.info" {t.Fatalf("walk %v", keys)}
+
+    u, err := s.Put("g-h.bin")
+    if err != nil {t.Fatal(err)}
+    u.Write(large)
+    if err := u.Abort(); err != nil {t.Fatal(err)}
+    if len(fake.uploads) != 0 {t.Fatal("aborted upload left behind")}
+    if _, ok := fake.objects["ci/g-h.bin"]; ok {t.Fatal("aborted upload committed")}
+
+    if err := s.Delete("a-b.bin"); err != nil {t.Fatal(err)}
+    if _, err := s.Get("a-b.bin"); err != ErrMiss {t.Fatalf("deleted: %v", err)}
+
+    bad := newTestS3(t, srv.URL, "wrong")
+    if _, err := bad.Get("c-d.bin"); err == nil || err == ErrMiss {t.Fatalf("bad signature accepted: %v", err)}
+}
+
+func TestTieredStorage(t *testing.T) {
+    fake, srv := newFakeS3(t, "cache")
+    remote := newTestS3(t, srv.URL, testSecret)
+    local := NewFileStorage(t.TempDir())
+    store := NewTieredStorage(local, remote)
+    filled := map[string]int64{}
+    store.OnFill = func(key string, size int64) { filled[key] = size }
+
+    data := make([]byte, 100 << 10)
+    rand.Read(data)
+    put(t, store, "a-b.bin", data)
+    if !bytes.Equal(fake.objects["a-b.bin"], data) {t.Fatal("remote not written")}
+    if b := get(t, local, "a-b.bin"); !bytes.Equal(b, data) {t.Fatal("local not written")}
+
+    // eviction only drops local copy
+    if err := removeArtifact(store, "a-b.bin"); err != nil {t.Fatal(err)}
+    if _, ok := fake.objects["a-b.bin"]; !ok {t.Fatal("remote deleted on eviction")}
+    if b := get(t, store, "a-b.bin"); !bytes.Equal(b, data) {t.Fatal("filled not match")}
+    if filled["a-b.bin"] != int64(len(data)) {t.Fatalf("fill not reported: %v", filled)}
+    if b := get(t, local, "a-b.bin"); !bytes.Equal(b, data) {t.Fatal("local not filled")}
+    if _, err := store.Get("x-y.bin"); err != ErrMiss {t.Fatalf("miss: %v", err)}
+
+    if err := store.Quarantine("a-b.bin"); err != nil {t.Fatal(err)}
+    if _, err := store.Get("a-b.bin"); err != ErrMiss {t.Fatalf("quarantined: %v", err)}
+    if store.tempDir() != local.temp {t.Fatal("temp dir not exposed")}
+}
+
+// gatedStorage holds reads of its objects past the first gate bytes until open is closed
+type gatedStorage struct {
+    Storage
+    gate int64
+    open chan struct{}
+}
+
+type gatedObject struct {
+    Object
+    s    *gatedStorage
+    read int64
+}
+
+func (g *gatedStorage) Get(key string) (Object, error) {
+    o, err := g.Storage.Get(key)
+    if err != nil || strings.HasSuffix(key, checksumExt) {return o, err}
+    return &gatedObject{Object: o, s: g}, nil
+}
+
+func (o *gatedObject) Read(p []byte) (int, error) {
+    if o.read >= o.s.gate { <-o.s.open }
+    if max := o.s.gate - o.read; max > 0 && int64(len(p)) > max { p = p[:max] }
+    n, err := o.Object.Read(p)
+    o.read += int64(n)
+    return n, err
+}
+
+func TestTieredStream(t *testing.T) {
+    remote := &gatedStorage{Storage: NewMemoryStorage(), gate: 1 << 10, open: make(chan struct{})}
+    local := NewMemoryStorage()
+    store := NewTieredStorage(local, remote)
+    filled := map[string]int64{}
+    store.OnFill = func(key string, size int64) { filled[key] = size }
+
+    data := make([]byte, 100 << 10)
+    rand.Read(data)
+    sum := sha256.Sum256(data)
+    close(remote.open)
+    put(t, remote, "a-b.bin", data)
+    if err := writeChecksum(remote, "a-b.bin", sum[:]); err != nil {t.Fatal(err)}
+    remote.open = make(chan struct{})
+
+    // served before remote is read through
+    o, err := store.Get("a-b.bin")
+    if err != nil {t.Fatal(err)}
+    head := make([]byte, remote.gate)
+    if _, err := io.ReadFull(o, head); err != nil {t.Fatal(err)}
+    if !bytes.Equal(head, data[:remote.gate]) {t.Fatal("head not match")}
+    if _, err := local.Stat("a-b.bin"); err != ErrMiss {t.Fatalf("filled before read through: %v", err)}
+    close(remote.open)
+    rest, err := ioutil.ReadAll(o)
+    if err != nil {t.Fatal(err)}
+    if !bytes.Equal(append(head, rest...), data) {t.Fatal("streamed not match")}
+    if err := o.Close(); err != nil {t.Fatal(err)}
+    if filled["a-b.bin"] != int64(len(data)) + checksumSize {t.Fatalf("fill not reported with checksum sidecar: %v", filled)}
+    if b := get(t, local, "a-b.bin"); !bytes.Equal(b, data) {t.Fatal("local not filled")}
+    if err := verify(local, "a-b.bin"); err != nil {t.Fatalf("local checksum: %v", err)}
+
+    // partially read objects aren't kept
+    put(t, remote, "c-d.bin", data)
+    o, err = store.Get("c-d.bin")
+    if err != nil {t.Fatal(err)}
+    io.ReadFull(o, head)
+    o.Close()
+    if _, err := local.Stat("c-d.bin"); err != ErrMiss {t.Fatalf("partial read filled: %v", err)}
+
+    // corrupt remote copies are dropped rather than filled
+    if err := writeChecksum(remote, "e-f.bin", sum[:]); err != nil {t.Fatal(err)}
+    put(t, remote, "e-f.bin", data[1:])
+    o, err = store.Get("e-f.bin")
+    if err != nil {t.Fatal(err)}
+    ioutil.ReadAll(o)
+    if err := o.Close(); err != errCorrupt {t.Fatalf("corrupt close: %v", err)}
+    if _, err := local.Stat("e-f.bin"); err != ErrMiss {t.Fatalf("corrupt filled: %v", err)}
+    if _, err := remote.Stat("e-f.bin"); err != ErrMiss {t.Fatalf("corrupt remote kept: %v", err)}
+}
+
+func TestS3Timeout(t *testing.T) {
+    stall := make(chan struct{})
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/cache/body" {
+            w.Header().Set("Content-Length", "100")
+            w.Write(make([]byte, 10))
+            w.(http.Flusher).Flush()
+        }
+        <-stall
+    }))
+    defer srv.Close()
+    defer close(stall)
+    s := newTestS3(t, srv.URL, testSecret)
+    s.Timeout = 100 * time.Millisecond
+
+    begin := time.Now()
+    if _, err := s.Get("header"); err == nil || err == ErrMiss {t.Fatalf("stalled header: %v", err)}
+    o, err := s.Get("body")
+    if err != nil {t.Fatal(err)}
+    if _, err := ioutil.ReadAll(o); err == nil {t.Fatal("stalled body read through")}
+    o.Close()
+    if elapse := time.Since(begin); elapse > 3 * time.Second {t.Fatalf("stalled requests took %v", elapse)}
+}
@@ -2,21 +2,25 @@ package server
 
 import (
     "bytes"
+    "context"
+    "crypto/tls"
     "encoding/binary"
     "encoding/hex"
+    "errors"
     "fmt"
     "go.uber.org/zap"
     "go.uber.org/zap/zapcore"
     "io"
-    "math/rand"
+    "math"
     "net"
     "os"
-    "path"
     "strconv"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
-var logger *zap.Logger
+var logger = zap.NewNop()
 
 type RequestType byte
 const (
@@ -43,6 +47,56 @@ type Context struct {
     Entity
     command [2]byte
     id [32]byte
+    conn *connection
+    ns *Namespace
+    role Role
+}
+
+// connection counts outstanding commands, only idle connections are closed while draining
+type connection struct {
+    received int64 // bytes transferred, first to keep them aligned for atomic access
+    sent     int64
+    net.Conn
+    ns   *Namespace
+    ip   string
+    since time.Time
+    busy int32
+    gets int32 // get responses not sent yet
+    idleTimeout     time.Duration
+    chunkTimeout    time.Duration
+    transferTimeout time.Duration
+    waiting bool      // reader is waiting for next command
+    rlimit  time.Time // transfer deadlines
+    wlimit  time.Time
+    rreason string    // why reads or writes timed out
+    wreason string
+}
+
+func (c *connection) acquire()   { atomic.AddInt32(&c.busy, 1) }
+func (c *connection) release()   { atomic.AddInt32(&c.busy, -1) }
+func (c *connection) idle() bool { return atomic.LoadInt32(&c.busy) == 0 }
+
+type staged struct {
+    file *File
+    key  string
+    size int64
+    t    RequestType
+}
+
+// transaction keeps uploads between ts and te in temp until they are committed together
+type transaction struct {
+    Entity
+    id    [32]byte
+    open  bool
+    files []*staged
+}
+
+func (t *transaction) discard() {
+    for _, f := range t.files {
+        if err := f.file.Abort(); err != nil { logger.Error("trx discard err", zap.String("file", f.file.Name()), zap.Error(err)) }
+    }
+    if len(t.files) > 0 { logger.Debug("trx discard", zap.String("guid", t.guid), zap.String("hash", t.hash), zap.Int("files", len(t.files))) }
+    t.files = nil
 }
 
 type Stream struct {
@@ -114,165 +168,450 @@ type CacheServer struct {
     Port     int
     Path     string
     LogLevel int
-    CacheCap int
+    CacheCap int64
+    DiskCap  int64
+    TempAge  time.Duration
+    Verify   bool
     DryRun   bool
-    temp     string
+    Mode     Mode
+    IdleTimeout     time.Duration // between commands, 0 disables it
+    ChunkTimeout    time.Duration // for every read or write within a command
+    TransferTimeout time.Duration // for an artifact body as a whole
+    MaxConns      int // 0 means unlimited
+    MaxConnsPerIP int
+    LimitWait     time.Duration // how long over limit connections wait for a slot before rejected
+    MinFreeDisk   int64 // readiness fails once free space of cache path drops below it, 0 disables the check
+    Throttle Throttle // initial bandwidth limits, adjustable through admin API
+    TLSCert  string
+    TLSKey   string
+    TLSClientCA string // clients must present a certificate signed by it if set
+    Storage  Storage
+    Upstream Upstream // parent cache of default namespace
+    Tokens   map[string]Role // tokens of default namespace
+    UpstreamPut bool
+    Namespaces Namespaces // served besides default namespace on Port
+    spaces   []*Namespace
+    limits   *limiter
+    throttle *throttler
+    forwards chan *forward
+    probe    *CacheServer /* serves readiness self-check */
+    listeners []net.Listener
+    conns    map[*connection]struct{}
+    draining int32
+    accepts  sync.WaitGroup /* accept loops */
+    group    sync.WaitGroup /* connections, added before they are handed to serve */
+    bg       context.Context
+    stop     context.CancelFunc
+    bgOnce   sync.Once
+    sync.Mutex
 }
 
-func (s *CacheServer) Listen() error {
-    listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+var ErrServerClosed = errors.New("server closed")
+
+// Listen serves connections of every namespace until ctx is done or Shutdown is called, then returns ErrServerClosed
+func (s *CacheServer) Listen(ctx context.Context) error {
+    spaces, err := s.namespaces()
+    if err != nil {return err}
+    config, cert, err := s.tlsConfig()
     if err != nil {return err}
+    var listeners []net.Listener
+    for _, ns := range spaces {
+        listener, err := net.Listen("tcp", fmt.Sprintf(":%d", ns.Port))
+        if err != nil {
+            for _, l := range listeners { l.Close() }
+            return err
+        }
+        if config != nil { listener = tls.NewListener(listener, config) }
+        listeners = append(listeners, listener)
+    }
+    s.Lock()
+    s.spaces = spaces
+    s.listeners = listeners
+    s.accepts.Add(len(listeners)) /* before Shutdown may wait for them */
+    if s.closing() {
+        for _, l := range listeners { l.Close() }
+    }
+    s.Unlock()
+    go func() {
+        <-ctx.Done()
+        for _, l := range listeners { l.Close() }
+    }()
     mcache.core.capacity = s.CacheCap
-    s.temp = path.Join(s.Path, "temp")
     {
         l, err := zap.NewDevelopment(zap.IncreaseLevel(zapcore.Level(s.LogLevel)))
         if err != nil { panic(err) }
         logger = l
     }
+    if cert != nil { go cert.watch(10 * time.Second, s.background().Done()) }
+    if s.MaxConns > 0 || s.MaxConnsPerIP > 0 { s.limits = newLimiter(s.MaxConns, s.MaxConnsPerIP) }
+    {
+        t, err := newThrottler(s.Throttle)
+        if err != nil {return err}
+        s.Lock()
+        s.throttle = t
+        s.Unlock()
+    }
+    for _, ns := range spaces {
+        s.Lock() /* admin API looks namespaces up meanwhile */
+        ns.open(s.TempAge, s.background().Done())
+        s.forwardFor(ns)
+        s.Unlock()
+    }
     //go mcache.core.stat()
+    for i := range listeners {
+        go func(listener net.Listener, ns *Namespace) {
+            defer s.accepts.Done()
+            s.accept(ctx, listener, ns)
+        }(listeners[i], spaces[i])
+    }
+    s.accepts.Wait()
+    return ErrServerClosed
+}
+
+func (s *CacheServer) accept(ctx context.Context, listener net.Listener, ns *Namespace) {
     for {
         c, err := listener.Accept()
-        if err != nil { continue }
-        go s.Handle(c)
+        if err != nil {
+            if ctx.Err() != nil || s.closing() {return}
+            continue
+        }
+        s.group.Add(1)
+        go s.admit(c, ns)
     }
 }
 
+func (s *CacheServer) closing() bool { return atomic.LoadInt32(&s.draining) == 1 }
+
+// background is cancelled by Shutdown, background goroutines of the server stop with it
+func (s *CacheServer) background() context.Context {
+    s.bgOnce.Do(func() { s.bg, s.stop = context.WithCancel(context.Background()) })
+    return s.bg
+}
+
+func (s *CacheServer) track(c net.Conn, ns *Namespace) *connection {
+    conn := &connection{Conn: c, ns: ns, since: time.Now(), idleTimeout: s.IdleTimeout, chunkTimeout: s.ChunkTimeout, transferTimeout: s.TransferTimeout}
+    conn.ip, _, _ = net.SplitHostPort(c.RemoteAddr().String())
+    s.throttle.attach(conn.ip)
+    s.Lock()
+    defer s.Unlock()
+    if s.conns == nil { s.conns = make(map[*connection]struct{}) }
+    s.conns[conn] = struct{}{}
+    return conn
+}
+
+func (s *CacheServer) untrack(c *connection) {
+    s.Lock()
+    defer s.Unlock()
+    delete(s.conns, c)
+    s.throttle.detach(c.ip)
+    s.group.Done()
+}
+
+// closeIdle closes connections without outstanding commands and reports how many are left
+func (s *CacheServer) closeIdle(force bool) int {
+    s.Lock()
+    defer s.Unlock()
+    for c := range s.conns {
+        if force || c.idle() { c.Close() }
+    }
+    return len(s.conns)
+}
+
+// Shutdown stops accepting connections and waits for in-flight commands to finish until ctx is done,
+// remaining connections are closed then, background goroutines are stopped and the temp directory is cleaned up.
+func (s *CacheServer) Shutdown(ctx context.Context) error {
+    atomic.StoreInt32(&s.draining, 1)
+    s.Lock()
+    for _, l := range s.listeners { l.Close() }
+    s.Unlock()
+    s.accepts.Wait() /* no more connections are added by accept loops */
+
+    var err error
+    ticker := time.NewTicker(100 * time.Millisecond)
+    defer ticker.Stop()
+    for s.closeIdle(false) > 0 {
+        select {
+        case <-ticker.C: continue
+        case <-ctx.Done(): err = ctx.Err()
+        }
+        logger.Warn("drain timeout", zap.Int("conns", s.closeIdle(true)))
+        break
+    }
+    s.group.Wait()
+    s.background()
+    s.stop()
+
+    for _, ns := range s.spaces {
+        if ns.temp == "" {continue}
+        if e := os.RemoveAll(ns.temp); e != nil { logger.Error("clean temp err", zap.String("path", ns.temp), zap.Error(e)) }
+    }
+    logger.Info("shutdown", zap.Error(err))
+    return err
+}
+
 func (s *CacheServer) Send(c net.Conn, event chan *Context) {
     conn := &Stream{Rwp: c}
     addr := c.RemoteAddr().String()
+    log := logger
+    if cc, ok := c.(*connection); ok && cc.ns.probe() { log = zap.NewNop() }
     outgoing := int64(0)
     ts := time.Now()
     defer func() {
         c.Close()
+        if cc, ok := c.(*connection); ok { cc.timedOut(cc.wreason, "write") }
+        for ctx := range event { ctx.conn.release() } /* unblock reader until it notices closed connection */
         if outgoing > 0 {
             elapse := time.Now().Sub(ts).Seconds()
             speed := float64(outgoing) / elapse
-            logger.Info("closed w", zap.String("addr", addr), zap.Int64("size", outgoing), zap.Float64("speed", speed), zap.Float64("elapse", elapse))
-        } else { logger.Info("closed w", zap.String("addr", addr)) }
+            log.Info("closed w", zap.String("addr", addr), zap.Int64("size", outgoing), zap.Float64("speed", speed), zap.Float64("elapse", elapse))
+        } else { log.Info("closed w", zap.String("addr", addr)) }
     }()
 
-    buf := make([]byte, 64<<10)
+    buf := getBuffer(64<<10)
+    defer putBuffer(buf)
     hdr := bytes.NewBuffer(buf[:0])
     for ctx := range event {
         cmd := string(ctx.command[:])
         switch cmd[0] {
         case 'g':
-            t := RequestType(cmd[1])
-
-            exists := true
-            var in *Stream
-            size := int64(0)
-            filename := path.Join(s.Path, ctx.guid[:2], ctx.guid + "-" + ctx.hash + "." + t.extension())
-            if s.DryRun {
-                in = &Stream{Rwp: &Air{}}
-                size = 2<<20
-            } else {
-                file, err := Open(filename, ctx.guid+ctx.hash+string(t))
-                if err == nil { size = file.size } else { exists = false }
-                in = &Stream{Rwp: file}
-            }
+            n, err := s.get(conn, ctx, buf, hdr)
+            outgoing += n
+            atomic.AddInt32(&ctx.conn.gets, -1)
+            ctx.conn.release()
+            if err != nil {return}
+        case 'a':
+            reply := []byte{'-', 'a'}
+            if ctx.role != RoleNone { reply[0] = '+' }
+            err := conn.Write(reply, len(reply))
+            ctx.conn.release()
+            if err != nil { logger.Error("send auth err", zap.Error(err));return }
+        }
+    }
+}
 
-            logger.Debug("get +++", zap.String("cmd", cmd), zap.String("guid", ctx.guid))
+func (s *CacheServer) get(conn *Stream, ctx *Context, buf []byte, hdr *bytes.Buffer) (int64, error) {
+    cmd := string(ctx.command[:])
+    t := RequestType(cmd[1])
+    ns := ctx.ns
+    begin := time.Now()
+    outgoing := int64(0)
 
-            hdr.Reset()
-            if !exists {
-                hdr.WriteByte('-')
-                hdr.WriteByte(byte(t))
-                logger.Debug("mis ---", zap.String("cmd", cmd), zap.String("guid", ctx.guid))
-            } else {
-                hdr.WriteByte('+')
-                hdr.WriteByte(byte(t))
-                sb := buf[len(buf)-8:]
-                binary.BigEndian.PutUint64(sb, uint64(size))
-                sh := buf[len(buf)-16:]
-                hex.Encode(sh, sb)
-                hdr.Write(sh)
+    exists := true
+    var in *Stream
+    size := int64(0)
+    key := artifactKey(ctx.guid, ctx.hash, t)
+    if s.DryRun {
+        in = &Stream{Rwp: &Air{}}
+        size = 2<<20
+    } else if !s.Mode.readable() { exists = false } else {
+        file, err := Open(ns.store, key, ns.uuid(ctx.Entity, t))
+        if err == nil && !file.c && s.Verify {
+            if file.filling() {
+                file, err = ns.fill(file, key, ns.uuid(ctx.Entity, t))
+            } else if err = ns.check(key); err != nil {
+                file.Close()
+                file = nil
             }
+        }
+        if err == nil { size = file.size } else { exists = false }
+        in = &Stream{Rwp: file}
+        if !exists && ns.Upstream != nil {
+            if r, n, ok := ns.fetch(ctx, t, key); ok { in, size, exists = r, n, true }
+        }
+    }
 
-            hdr.Write(ctx.id[:]) /* guid + hash */
-            if err := conn.Write(hdr.Bytes(), hdr.Len()); err != nil { logger.Error("send get + err", zap.Error(err));return }
-            outgoing += int64(hdr.Len())
-            if !exists {continue}
-            if size == 0 {panic(filename)}
+    logger.Debug("get +++", zap.String("cmd", cmd), zap.String("guid", ctx.guid))
 
-            logger.Debug("get >>>", zap.String("cmd", cmd), zap.String("guid", ctx.guid), zap.Int64("size", size))
+    hdr.Reset()
+    if !exists {
+        hdr.WriteByte('-')
+        hdr.WriteByte(byte(t))
+        logger.Debug("mis ---", zap.String("cmd", cmd), zap.String("guid", ctx.guid))
+    } else {
+        hdr.WriteByte('+')
+        hdr.WriteByte(byte(t))
+        sb := buf[len(buf)-8:]
+        binary.BigEndian.PutUint64(sb, uint64(size))
+        sh := buf[len(buf)-16:]
+        hex.Encode(sh, sb)
+        hdr.Write(sh)
+    }
 
-            if file, ok := in.Rwp.(*File); ok && file.c {
-                m := file.m
-                if err := conn.Write(m.Bytes(), m.Len()); err != nil {
-                    logger.Error("get sent cache err", zap.Int64("size", size), zap.Error(err))
-                    return
-                }
-                outgoing += int64(m.Len())
-                logger.Debug("get success", zap.String("cmd", cmd), zap.Int("sent", m.Len()), zap.String("file", filename), zap.Bool("cache", true))
-                continue
+    hdr.Write(ctx.id[:]) /* guid + hash */
+    if err := conn.Write(hdr.Bytes(), hdr.Len()); err != nil {
+        if exists { in.Close() } /* releases file, memory cache pin or upstream connection */
+        logger.Error("send get + err", zap.Error(err))
+        return outgoing, err
+    }
+    outgoing += int64(hdr.Len())
+    if !exists {
+        metrics.gets.with(ns.Name, t.extension(), "miss").add(1)
+        observe(ns, cmd, begin)
+        return outgoing, nil
+    }
+    defer ctx.conn.limit(&ctx.conn.wlimit)()
+    if !s.DryRun { ns.disk.touch(key) }
+
+    logger.Debug("get >>>", zap.String("cmd", cmd), zap.String("guid", ctx.guid), zap.Int64("size", size))
+
+    if file, ok := in.Rwp.(*File); ok && file.c {
+        defer in.Close() /* unpins memory cache entry */
+        m := file.m.Bytes()
+        for sent := 0; sent < len(m); {
+            num := len(buf)
+            if len(m) - sent < num { num = len(m) - sent }
+            s.throttle.wait(ctx.conn.ip, true, int64(num))
+            if err := conn.Write(m[sent:], num); err != nil {
+                logger.Error("get sent cache err", zap.Int64("size", size), zap.Error(err))
+                return outgoing + int64(sent), err
             }
+            sent += num
+        }
+        outgoing += int64(len(m))
+        s.served(ns, cmd, int64(len(m)), begin)
+        logger.Debug("get success", zap.String("cmd", cmd), zap.Int("sent", len(m)), zap.String("key", key), zap.Bool("cache", true))
+        return outgoing, nil
+    }
 
-            sent := int64(0)
-            for sent < size {
-                num := int64(len(buf))
-                if size - sent < num { num = size - sent }
-                if err := in.Read(buf, int(num)); err != nil {
-                    in.Close()
-                    logger.Error("get read file err", zap.Int64("sent", sent), zap.Int64("size", size), zap.Error(err))
-                    return
-                } else {
-                    sent += num
-                    if err := conn.Write(buf, int(num)); err != nil {
-                        in.Close()
-                        logger.Error("get sent body err", zap.Int64("sent", sent), zap.Int64("size", size), zap.Error(err))
-                        return
-                    }
-                }
-            }
+    if file, ok := in.Rwp.(*File); ok && file.fd() != nil && ctx.conn.tcp() != nil {
+        sent, err := ctx.conn.sendFile(file.fd(), size, s.throttle)
+        in.Close()
+        if err != nil {
+            logger.Error("get sendfile err", zap.Int64("sent", sent), zap.Int64("size", size), zap.Error(err))
+            return outgoing + sent, err
+        }
+        s.served(ns, cmd, sent, begin)
+        logger.Debug("get success", zap.String("cmd", cmd), zap.Int64("sent", sent), zap.String("key", key), zap.Bool("sendfile", true))
+        return outgoing + sent, nil
+    }
+
+    sent := int64(0)
+    for sent < size {
+        num := int64(len(buf))
+        if size - sent < num { num = size - sent }
+        if err := in.Read(buf, int(num)); err != nil {
             in.Close()
-            logger.Debug("get success", zap.String("cmd", cmd), zap.Int64("sent", sent), zap.String("file", filename))
-            outgoing += sent
+            logger.Error("get read file err", zap.Int64("sent", sent), zap.Int64("size", size), zap.Error(err))
+            return outgoing + sent, err
+        } else {
+            sent += num
+            s.throttle.wait(ctx.conn.ip, true, num)
+            if err := conn.Write(buf, int(num)); err != nil {
+                in.Close()
+                logger.Error("get sent body err", zap.Int64("sent", sent), zap.Int64("size", size), zap.Error(err))
+                return outgoing + sent, err
+            }
         }
     }
+    in.Close()
+    s.served(ns, cmd, sent, begin)
+    logger.Debug("get success", zap.String("cmd", cmd), zap.Int64("sent", sent), zap.String("key", key))
+    return outgoing + sent, nil
+}
+
+func (s *CacheServer) served(ns *Namespace, cmd string, size int64, begin time.Time) {
+    t := RequestType(cmd[1])
+    metrics.gets.with(ns.Name, t.extension(), "hit").add(1)
+    metrics.getBytes.with(ns.Name, t.extension()).add(size)
+    observe(ns, cmd, begin)
 }
 
+// observe records latency of cmd, traffic of readiness self-check is left out
+func observe(ns *Namespace, cmd string, begin time.Time) {
+    if ns.probe() {return}
+    metrics.latency.with(cmd).observe(time.Since(begin).Seconds())
+}
+
+// Handle serves a connection of default namespace
+// Handle serves a connection accepted by caller, callers stop handing connections over before Shutdown
 func (s *CacheServer) Handle(c net.Conn) {
-    conn := &Stream{Rwp: c}
+    s.group.Add(1)
+    s.serve(c, s.fallback())
+}
+
+func (s *CacheServer) serve(c net.Conn, ns *Namespace) {
+    cc := s.track(c, ns)
+    conn := &Stream{Rwp: cc}
     addr := c.RemoteAddr().String()
-    logger.Info("connected", zap.String("addr", addr))
+    log := logger
+    if ns.probe() { log = zap.NewNop() }
+    log.Info("connected", zap.String("addr", addr), zap.String("namespace", ns.Name))
+    metrics.connections.with(ns.Name).add(1)
     event := make(chan *Context)
-    go s.Send(c, event)
+    go func() {
+        defer s.untrack(cc)
+        defer cc.recovered()
+        s.Send(cc, event)
+    }()
 
     ts := time.Now()
     incoming := int64(0)
+    trx := &transaction{}
+    defer cc.recovered()
     defer func() {
         close(event)
+        trx.discard()
+        cc.timedOut(cc.rreason, "read")
+        metrics.connections.with(ns.Name).add(-1)
         if incoming > 0 {
             elapse := time.Now().Sub(ts).Seconds()
             speed := float64(incoming) / elapse
-            logger.Info("closed r", zap.String("addr", addr), zap.Int64("size", incoming), zap.Float64("speed", speed), zap.Float64("elapse", elapse))
-        } else { logger.Info("closed r", zap.String("addr", addr)) }
+            log.Info("closed r", zap.String("addr", addr), zap.Int64("size", incoming), zap.Float64("speed", speed), zap.Float64("elapse", elapse))
+        } else { log.Info("closed r", zap.String("addr", addr)) }
     }()
 
-    buf := make([]byte, 16<<10)
+    buf := getBuffer(16<<10)
+    defer putBuffer(buf)
 
     ver := buf[:2]
     if err := conn.Read(ver, len(ver)); err != nil { logger.Error("read version err", zap.Error(err));return }
 
-    v, _ := strconv.ParseInt(string(ver), 16, 32)
+    v, err := strconv.ParseInt(string(ver), 16, 32)
+    if err != nil { cc.malformed(malformedVersion, zap.ByteString("version", ver));return }
     if err := conn.Write([]byte(fmt.Sprintf("%08x", v)), 8); err != nil {
         logger.Error("echo version err", zap.Error(err))
         return
     }
 
-    trx := &Entity{}
+    role := ns.role()
     for {
+        if s.closing() && !trx.open {return}
         cmd := buf[:2]
+        cc.waiting = true
         if err := conn.Read(cmd, len(cmd)); err != nil {
-            if err != io.EOF { logger.Error("read command err", zap.Error(err)) }
+            if err != io.EOF && !s.closing() && cc.rreason == "" { logger.Error("read command err", zap.Error(err)) }
             return
         }
+        cc.waiting = false
 
         incoming += 2
+        if !role.permits(cmd[0]) {
+            logger.Warn("command denied", zap.String("cmd", string(cmd)), zap.String("addr", addr), zap.Stringer("role", role))
+            metrics.auth.with(ns.Name, "denied").add(1)
+            return
+        }
         switch cmd[0] {
         case 'q': return
+        case 'a':
+            if cmd[1] != 'u' { cc.malformed(malformedCommand, zap.ByteString("cmd", cmd));return }
+            ctx := &Context{conn: cc, ns: ns}
+            copy(ctx.command[0:], cmd)
+            token, err := conn.ReadString(buf) /* cmd is overwritten */
+            if err != nil { logger.Error("read token err", zap.Error(err));return }
+            incoming += 2 + int64(len(token))
+            if len(ns.Tokens) > 0 { role = ns.authenticate(token) }
+            ctx.role = role
+            cc.acquire()
+            event <- ctx
+            if role == RoleNone {
+                logger.Warn("auth failure", zap.String("addr", addr), zap.String("namespace", ns.Name))
+                metrics.auth.with(ns.Name, "failure").add(1)
+                return
+            }
+            logger.Debug("auth", zap.String("addr", addr), zap.Stringer("role", role))
+            metrics.auth.with(ns.Name, "success").add(1)
         case 'g':
+            if !RequestType(cmd[1]).valid() { cc.malformed(malformedType, zap.ByteString("cmd", cmd));return }
             cmd := string(cmd)
             id := buf[:32]
             if err := conn.Read(id, len(id)); err != nil { logger.Error("read get id err", zap.Error(err));return }
@@ -282,73 +621,143 @@ func (s *CacheServer) Handle(c net.Conn) {
             ctx.guid = hex.EncodeToString(id[:16])
             ctx.hash = hex.EncodeToString(id[16:])
             copy(ctx.id[:], id)
+            ctx.conn = cc
+            ctx.ns = ns
+            cc.acquire()
+            atomic.AddInt32(&cc.gets, 1)
             logger.Debug("get", zap.String("cmd", cmd), zap.String("guid", ctx.guid), zap.String("hash", ctx.hash))
             event <- ctx
 
         case 'p':
             t := RequestType(cmd[1])
+            if !t.valid() { cc.malformed(malformedType, zap.ByteString("cmd", cmd));return }
+            if trx.guid == "" { cc.malformed(malformedTransaction, zap.ByteString("cmd", cmd));return }
             cmd := string(cmd)
+            begin := time.Now()
+            cc.acquire()
             b := buf[:16]
             if err := conn.Read(b, len(b)); err != nil {logger.Error("put read size err", zap.Error(err));return}
             incoming += int64(len(b))
-            size, err := strconv.ParseInt(string(b), 16, 32)
-            if err != nil {logger.Error("put parse size err", zap.Error(err));return}
+            n, err := strconv.ParseUint(string(b), 16, 64)
+            if err != nil || n > math.MaxInt64 { cc.malformed(malformedSize, zap.ByteString("size", b));return }
+            size := int64(n)
             logger.Debug("put", zap.String("cmd", cmd), zap.String("guid", trx.guid), zap.Int64("size", size))
 
-            dir := path.Join(s.Path, trx.guid[:2])
-            if _, err := os.Stat(dir); err != nil || os.IsNotExist(err) { os.MkdirAll(dir, 0700) }
-            filename := path.Join(dir, trx.guid + "-" + trx.hash + "." + t.extension())
+            key := artifactKey(trx.guid, trx.hash, t)
 
             var out *Stream
-            if s.DryRun { out = &Stream{Rwp: Air{}} } else {
-                name := buf[:32]
-                rand.Read(name)
-                if _, err := os.Stat(s.temp); err != nil || os.IsNotExist(err) { os.MkdirAll(s.temp, 0700) }
-                file, err := NewFile(path.Join(s.temp, hex.EncodeToString(name)), trx.guid+trx.hash+string(t), size)
-                if err != nil {logger.Error("put init err", zap.String("file", filename), zap.Error(err));return}
+            var file *File
+            if s.DryRun || !s.Mode.writable() { out = &Stream{Rwp: Air{}} } else {
+                file, err = NewFile(ns.store, key, ns.uuid(trx.Entity, t), size)
+                if err != nil {logger.Error("put init err", zap.String("key", key), zap.Error(err));return}
                 out = &Stream{Rwp: file}
             }
 
             received := int64(0)
+            lift := cc.limit(&cc.rlimit)
+            if dst := file.fd(); dst != nil && cc.tcp() != nil {
+                if received, err = cc.receiveFile(dst, size, s.throttle); err != nil {
+                    file.Abort()
+                    if _, ok := err.(net.Error); !ok && err != io.EOF { logger.Error("put splice err", zap.Int64("received", received), zap.Int64("size", size), zap.Error(err)) }
+                    return
+                }
+                if err := digest(file.h, dst, size, buf); err != nil {
+                    file.Abort()
+                    logger.Error("put digest err", zap.String("key", key), zap.Error(err))
+                    return
+                }
+            }
             for received < size {
                 num := int64(len(buf))
                 if size - received < num { num = size - received }
-                if err := conn.Read(buf, int(num)); err != nil {out.Close();os.Remove(out.Name());return} else {
+                if err := conn.Read(buf, int(num)); err != nil {
+                    if file != nil { file.Abort() }
+                    return
+                } else {
                     received += num
+                    s.throttle.wait(cc.ip, false, num)
                     if err := out.Write(buf, int(num)); err != nil {
-                        out.Close()
-                        os.Remove(out.Name())
+                        file.Abort()
                         logger.Error("put save err", zap.Int64("received", received), zap.Int64("size", size), zap.Error(err))
                         return
                     }
                 }
             }
+            lift()
             out.Close()
-            if _, ok := out.Rwp.(*File); ok {
-                if err := os.Rename(out.Name(), filename); err != nil {
-                    logger.Error("put failure", zap.String("cmd", cmd), zap.Int64("received", received), zap.String("file", filename), zap.Error(err))
-                    return
+            if file != nil {
+                trx.files = append(trx.files, &staged{file: file, key: key, size: received, t: t})
+                if !trx.open {
+                    if err := s.commit(ns, trx); err != nil {
+                        logger.Error("put failure", zap.String("cmd", cmd), zap.Int64("received", received), zap.String("key", key), zap.Error(err))
+                        return
+                    }
                 }
             }
 
-            logger.Debug("put success", zap.String("cmd", cmd), zap.Int64("received", received), zap.String("file", filename))
             incoming += received
+            if s.Mode.writable() {
+                logger.Debug("put success", zap.String("cmd", cmd), zap.Int64("received", received), zap.String("key", key))
+                metrics.puts.with(ns.Name, t.extension()).add(1)
+                metrics.putBytes.with(ns.Name, t.extension()).add(received)
+            } else {
+                logger.Debug("put discarded", zap.String("cmd", cmd), zap.Int64("received", received), zap.String("key", key))
+                metrics.discarded.with(ns.Name, t.extension()).add(1)
+            }
+            observe(ns, cmd, begin)
+            cc.release()
 
         case 't':
             switch cmd[1] {
             case 's':
                 id := buf[:32]
                 if err := conn.Read(id, len(id)); err != nil {logger.Error("trx read err", zap.Error(err));return}
+                trx.discard() /* previous one is never ended */
+                if !trx.open { cc.acquire() } /* an open transaction keeps connection busy */
+                copy(trx.id[:], id)
                 trx.guid = hex.EncodeToString(id[:16])
                 trx.hash = hex.EncodeToString(id[16:])
+                trx.open = true
                 logger.Debug("trx open", zap.String("guid", trx.guid), zap.String("hash", trx.hash))
                 incoming += int64(len(id))
             case 'e':
+                begin := time.Now()
+                if trx.open { cc.release() }
+                trx.open = false
+                if err := s.commit(ns, trx); err != nil {
+                    logger.Error("trx commit err", zap.String("guid", trx.guid), zap.String("hash", trx.hash), zap.Error(err))
+                    return
+                }
                 logger.Debug("trx done", zap.String("guid", trx.guid), zap.String("hash", trx.hash))
+                observe(ns, "te", begin)
+            default:
+                cc.malformed(malformedCommand, zap.ByteString("cmd", cmd))
+                return
             }
         default:
-            logger.Error("unsupported command", zap.String("cmd", string(cmd)))
+            cc.malformed(malformedCommand, zap.ByteString("cmd", cmd))
             return
         }
     }
-}
\ No newline at end of file
+}
+
+// commit renames every staged upload into place, files already committed are rolled back on failure
+func (s *CacheServer) commit(ns *Namespace, trx *transaction) error {
+    for i, f := range trx.files {
+        if err := f.file.Commit(); err != nil {
+            /* the failed one too, remote tier may have published it before local one failed */
+            for _, c := range trx.files[:i+1] {
+                purgeArtifact(ns.store, c.key)
+                ns.disk.remove(c.key)
+                mcache.core.delete(c.file.uuid) /* an older copy mustn't outlive rollback */
+            }
+            trx.discard() /* committed ones only give back their buffers */
+            return err
+        }
+        ns.disk.add(f.key, f.file.footprint(f.size))
+    }
+    for _, f := range trx.files { f.file.cache() } /* not before all of them are in */
+    s.forward(ns, trx, trx.files)
+    trx.files = nil
+    return nil
+}
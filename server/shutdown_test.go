@@ -0,0 +1,119 @@
+package server
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+)
+
+// shutdown runs Shutdown in background with timeout, its result is sent once it returns
+func shutdown(s *CacheServer, timeout time.Duration) chan error {
+    done := make(chan error, 1)
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        defer cancel()
+        done <- s.Shutdown(ctx)
+    }()
+    return done
+}
+
+func TestShutdownDrain(t *testing.T) {
+    h := newHarness(t, "pipe", nil)
+    var log bytes.Buffer
+    idle := h.connect(&log)
+    busy := h.connect(&log)
+    id := testEntity(0x51)
+    body := testBody(RequestTypeBin, id)
+    busy.send("ts", id, fmt.Sprintf("p%c%016x", RequestTypeBin, len(body)), body[:4]) /* pipe writes return once read */
+    ns := h.server.fallback()
+    if _, err := os.Stat(ns.temp); err != nil {t.Fatal(err)}
+
+    done := shutdown(h.server, 5 * time.Second)
+    idle.closed()
+    select {
+    case err := <-done: t.Fatalf("shutdown returned with transaction open: %v", err)
+    case <-time.After(200 * time.Millisecond):
+    }
+    /* in-flight transaction finishes, no more commands are read after it */
+    busy.send(body[4:], "te")
+    if err := <-done; err != nil {t.Fatal(err)}
+    busy.closed()
+
+    if _, err := ns.store.Stat(artifactKey(fmt.Sprintf("%x", id[:16]), fmt.Sprintf("%x", id[16:]), RequestTypeBin)); err != nil {t.Fatalf("drained put not committed: %v", err)}
+    if _, err := os.Stat(ns.temp); !os.IsNotExist(err) {t.Fatalf("temp dir left: %v", err)}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+    h := newHarness(t, "pipe", nil)
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x52)
+    s.send("ts", id, fmt.Sprintf("p%c%016x", RequestTypeBin, 100), "stalled")
+    ns := h.server.fallback()
+
+    begin := time.Now()
+    if err := <-shutdown(h.server, 200 * time.Millisecond); err != context.DeadlineExceeded {t.Fatalf("shutdown: %v", err)}
+    if elapse := time.Since(begin); elapse > 2 * time.Second {t.Fatalf("shutdown took %v", elapse)}
+    s.closed()
+    if _, err := ns.store.Stat(artifactKey(fmt.Sprintf("%x", id[:16]), fmt.Sprintf("%x", id[16:]), RequestTypeBin)); err != ErrMiss {t.Fatalf("stalled put committed: %v", err)}
+    if _, err := os.Stat(ns.temp); !os.IsNotExist(err) {t.Fatalf("temp dir left: %v", err)}
+}
+
+// goroutines counts goroutines running fn
+func goroutines(fn string) int {
+    buf := make([]byte, 1 << 20)
+    return strings.Count(string(buf[:runtime.Stack(buf, true)]), fn + "(")
+}
+
+func TestShutdownListen(t *testing.T) {
+    s := &CacheServer{Path: t.TempDir(), TempAge: time.Hour}
+    background := []string{"(*diskCache).janitor", "(*Namespace).sweeper"}
+    base := map[string]int{}
+    for _, fn := range background { base[fn] = goroutines(fn) }
+    /* as Listen does, which replaces global logger */
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {t.Fatal(err)}
+    ns := s.fallback()
+    s.Lock()
+    s.listeners = []net.Listener{l}
+    s.accepts.Add(1)
+    s.Unlock()
+    go func() {
+        defer s.accepts.Done()
+        s.accept(context.Background(), l, ns)
+    }()
+    addr := l.Addr().String()
+
+    /* connections keep coming while shutting down */
+    stop := make(chan struct{})
+    dialed := make(chan struct{})
+    go func() {
+        defer close(dialed)
+        for {
+            select {
+            case <-stop: return
+            default:
+            }
+            if c, err := net.Dial("tcp", addr); err == nil {
+                c.Write([]byte("fe"))
+                c.Close()
+            }
+        }
+    }()
+    time.Sleep(50 * time.Millisecond)
+    if err := <-shutdown(s, 5 * time.Second); err != nil {t.Fatal(err)}
+    close(stop)
+    <-dialed
+    for _, fn := range background {
+        /* those of servers shut down by earlier tests may still be exiting when counted */
+        for deadline := time.Now().Add(time.Second); goroutines(fn) > base[fn]; time.Sleep(time.Millisecond) {
+            if time.Now().After(deadline) {t.Fatalf("%d %s left running", goroutines(fn) - base[fn], fn)}
+        }
+    }
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// ByteSize is a byte count flag accepting an optional K/M/G/T suffix in powers of 1024
+type ByteSize int64
+
+func (b *ByteSize) String() string {
+    if b == nil {return "0"}
+    v := int64(*b)
+    for i := 4; i > 0; i-- {
+        if n := int64(1) << (10 * uint(i)); v != 0 && v % n == 0 { return strconv.FormatInt(v / n, 10) + "KMGT"[i-1:i] }
+    }
+    return strconv.FormatInt(v, 10)
+}
+
+func (b *ByteSize) Set(v string) error {
+    n, err := ParseByteSize(v)
+    if err != nil {return err}
+    *b = ByteSize(n)
+    return nil
+}
+
+func ParseByteSize(v string) (int64, error) {
+    s := strings.ToUpper(strings.TrimSpace(v))
+    s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+    shift := uint(0)
+    if n := len(s); n > 0 {
+        if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+            shift = 10 * uint(i + 1)
+            s = s[:n-1]
+        }
+    }
+    n, err := strconv.ParseFloat(s, 64)
+    if err != nil || n < 0 {return 0, fmt.Errorf("invalid byte size: %s", v)}
+    return int64(n * float64(int64(1) << shift)), nil
+}
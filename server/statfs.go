@@ -0,0 +1,12 @@
+// +build !windows
+
+package server
+
+import "syscall"
+
+// diskFree reports bytes available to unprivileged users on the filesystem of path
+func diskFree(path string) (int64, error) {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(path, &st); err != nil {return 0, err}
+    return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
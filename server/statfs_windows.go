@@ -0,0 +1,16 @@
+package server
+
+import (
+    "syscall"
+    "unsafe"
+)
+
+// diskFree reports bytes available to the current user on the volume of path
+func diskFree(path string) (int64, error) {
+    p, err := syscall.UTF16PtrFromString(path)
+    if err != nil {return 0, err}
+    proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+    var free uint64
+    if r, _, err := proc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {return 0, err}
+    return int64(free), nil
+}
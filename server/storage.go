@@ -0,0 +1,200 @@
+package server
+
+import (
+    "encoding/hex"
+    "io"
+    "math/rand"
+    "os"
+    "io/ioutil"
+    "path"
+    "strings"
+    "time"
+)
+
+// Storage persists artifacts addressed by key in form of <guid>-<hash>.<ext>
+type Storage interface {
+    // Get opens an artifact for reading, it returns ErrMiss if the key doesn't exist
+    Get(key string) (Object, error)
+    // Put stages an upload which becomes visible after Commit
+    Put(key string) (Upload, error)
+    Stat(key string) (Info, error)
+    Delete(key string) error
+    // Walk visits every stored key in no particular order
+    Walk(fn func(info Info) error) error
+}
+
+type Info struct {
+    Key   string
+    Size  int64
+    Mtime time.Time
+}
+
+type Object interface {
+    io.ReadCloser
+    Size() int64
+}
+
+type Upload interface {
+    io.Writer
+    Commit() error
+    Abort() error
+}
+
+func artifactKey(guid string, hash string, t RequestType) string {
+    return guid + "-" + hash + "." + t.extension()
+}
+
+// parseKey splits a key made by artifactKey, ok is false for others such as checksum sidecars
+func parseKey(key string) (e Entity, t RequestType, ok bool) {
+    dash, dot := strings.IndexByte(key, '-'), strings.LastIndexByte(key, '.')
+    if dash < 0 || dot < dash {return}
+    for _, r := range []RequestType{RequestTypeBin, RequestTypeInf, RequestTypeRes} {
+        if key[dot+1:] == r.extension() {return Entity{guid: key[:dash], hash: key[dash+1:dot]}, r, true}
+    }
+    return
+}
+
+// FileStorage is the on-disk layout Root/<guid[:2]>/<key>, uploads are staged in Root/temp
+type FileStorage struct {
+    Root string
+    temp string
+}
+
+func NewFileStorage(root string) *FileStorage {
+    return &FileStorage{Root: root, temp: path.Join(root, "temp")}
+}
+
+func (f *FileStorage) tempDir() string { return f.temp }
+
+func (f *FileStorage) name(key string) string {
+    if len(key) < 2 {return path.Join(f.Root, key)}
+    return path.Join(f.Root, key[:2], key)
+}
+
+type fileObject struct {
+    *os.File
+    size int64
+}
+
+func (o *fileObject) Size() int64 { return o.size }
+
+func (f *FileStorage) Get(key string) (Object, error) {
+    file, err := os.Open(f.name(key))
+    if err != nil {
+        if os.IsNotExist(err) {return nil, ErrMiss}
+        return nil, err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    return &fileObject{File: file, size: info.Size()}, nil
+}
+
+type fileUpload struct {
+    *os.File
+    name string
+}
+
+func (u *fileUpload) Commit() error {
+    if err := u.File.Close(); err != nil {
+        os.Remove(u.File.Name())
+        return err
+    }
+    dir := path.Dir(u.name)
+    if _, err := os.Stat(dir); err != nil || os.IsNotExist(err) { os.MkdirAll(dir, 0700) }
+    if err := os.Rename(u.File.Name(), u.name); err != nil {
+        os.Remove(u.File.Name())
+        return err
+    }
+    return nil
+}
+
+func (u *fileUpload) Abort() error {
+    u.File.Close()
+    return os.Remove(u.File.Name())
+}
+
+func (f *FileStorage) Put(key string) (Upload, error) {
+    if _, err := os.Stat(f.temp); err != nil || os.IsNotExist(err) { os.MkdirAll(f.temp, 0700) }
+    b := make([]byte, 16)
+    rand.Read(b)
+    file, err := os.OpenFile(path.Join(f.temp, hex.EncodeToString(b)), os.O_CREATE | os.O_RDWR, 0700)
+    if err != nil {return nil, err}
+    return &fileUpload{File: file, name: f.name(key)}, nil
+}
+
+func (f *FileStorage) Stat(key string) (Info, error) {
+    info, err := os.Stat(f.name(key))
+    if err != nil {
+        if os.IsNotExist(err) {return Info{}, ErrMiss}
+        return Info{}, err
+    }
+    return Info{Key: key, Size: info.Size(), Mtime: info.ModTime()}, nil
+}
+
+func (f *FileStorage) Delete(key string) error {
+    if err := os.Remove(f.name(key)); err != nil {
+        if os.IsNotExist(err) {return ErrMiss}
+        return err
+    }
+    return nil
+}
+
+// Walk visits Root/<xx>/<xx...> only, so that temp, quarantine and nested namespace directories are left out
+func (f *FileStorage) Walk(fn func(info Info) error) error {
+    dirs, err := ioutil.ReadDir(f.Root)
+    if err != nil {
+        if os.IsNotExist(err) {return nil}
+        return err
+    }
+    for _, dir := range dirs {
+        if !dir.IsDir() || len(dir.Name()) != 2 {continue}
+        files, err := ioutil.ReadDir(path.Join(f.Root, dir.Name()))
+        if err != nil {continue}
+        for _, info := range files {
+            if info.IsDir() || !strings.HasPrefix(info.Name(), dir.Name()) {continue}
+            if err := fn(Info{Key: info.Name(), Size: info.Size(), Mtime: info.ModTime()}); err != nil {return err}
+        }
+    }
+    return nil
+}
+
+// Touch stamps modification time of an artifact with its last access, which scan restores LRU order from
+func (f *FileStorage) Touch(key string, t time.Time) error {
+    if err := os.Chtimes(f.name(key), t, t); err != nil {
+        if os.IsNotExist(err) {return ErrMiss}
+        return err
+    }
+    return nil
+}
+
+// Quarantine moves an artifact out of cache tree for inspection
+func (f *FileStorage) Quarantine(key string) error {
+    dir := path.Join(f.Root, "quarantine")
+    if _, err := os.Stat(dir); err != nil || os.IsNotExist(err) { os.MkdirAll(dir, 0700) }
+    return os.Rename(f.name(key), path.Join(dir, key))
+}
+
+func (f *FileStorage) DeleteQuarantined(key string) error {
+    if err := os.Remove(path.Join(f.Root, "quarantine", key)); err != nil {
+        if os.IsNotExist(err) {return ErrMiss}
+        return err
+    }
+    return nil
+}
+
+// WalkQuarantined visits artifacts moved aside by Quarantine
+func (f *FileStorage) WalkQuarantined(fn func(info Info) error) error {
+    files, err := ioutil.ReadDir(path.Join(f.Root, "quarantine"))
+    if err != nil {
+        if os.IsNotExist(err) {return nil}
+        return err
+    }
+    for _, info := range files {
+        if info.IsDir() {continue}
+        if err := fn(Info{Key: info.Name(), Size: info.Size(), Mtime: info.ModTime()}); err != nil {return err}
+    }
+    return nil
+}
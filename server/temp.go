@@ -0,0 +1,65 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "io/ioutil"
+    "os"
+    "path"
+    "time"
+)
+
+// sweep removes files under dir last modified before deadline
+func sweep(dir string, deadline time.Time) (int, int64, error) {
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        if os.IsNotExist(err) {return 0, 0, nil}
+        return 0, 0, err
+    }
+    num, size := 0, int64(0)
+    for _, f := range files {
+        if f.IsDir() || !f.ModTime().Before(deadline) {continue}
+        if err := os.Remove(path.Join(dir, f.Name())); err != nil {
+            if !os.IsNotExist(err) { logger.Error("sweep temp err", zap.String("file", f.Name()), zap.Error(err)) }
+            continue
+        }
+        num++
+        size += f.Size()
+    }
+    return num, size, nil
+}
+
+// recoverTemp deletes partial uploads left behind by a previous process
+func (ns *Namespace) recoverTemp() {
+    num, size, err := sweep(ns.temp, time.Now())
+    if err != nil { logger.Error("recover temp err", zap.String("path", ns.temp), zap.Error(err));return }
+    ns.swept(num, size)
+    logger.Info("recover temp", zap.String("path", ns.temp), zap.Int("files", num), zap.Int64("size", size))
+}
+
+// sweeper periodically removes temp files untouched for longer than age, such as uploads of stuck connections
+func (ns *Namespace) sweeper(age time.Duration, done <-chan struct{}) {
+    interval := age / 4
+    if interval < time.Minute { interval = time.Minute }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-done: return
+        }
+        ns.sweepTemp(age)
+    }
+}
+
+// sweepTemp removes temp files untouched for longer than age
+func (ns *Namespace) sweepTemp(age time.Duration) {
+    num, size, err := sweep(ns.temp, time.Now().Add(-age))
+    if err != nil { logger.Error("sweep temp err", zap.String("path", ns.temp), zap.Error(err));return }
+    ns.swept(num, size)
+    if num > 0 { logger.Info("sweep temp", zap.String("path", ns.temp), zap.Int("files", num), zap.Int64("size", size), zap.Duration("age", age)) }
+}
+
+func (ns *Namespace) swept(num int, size int64) {
+    metrics.swept.with(ns.Name).add(int64(num))
+    metrics.sweptBytes.with(ns.Name).add(size)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestTempSweep(t *testing.T) {
+    root := t.TempDir()
+    temp := filepath.Join(root, "temp")
+    plant := func(name string, size int, age time.Duration) {
+        t.Helper()
+        file := filepath.Join(temp, name)
+        if err := ioutil.WriteFile(file, make([]byte, size), 0644); err != nil {t.Fatal(err)}
+        mtime := time.Now().Add(-age)
+        if err := os.Chtimes(file, mtime, mtime); err != nil {t.Fatal(err)}
+    }
+    exists := func(name string) bool {
+        _, err := os.Stat(filepath.Join(temp, name))
+        return err == nil
+    }
+    counted := func() (int64, int64) { return metrics.swept.with("sweep-test").get(), metrics.sweptBytes.with("sweep-test").get() }
+    if err := os.MkdirAll(filepath.Join(temp, "dir"), 0755); err != nil {t.Fatal(err)}
+
+    /* partial uploads of a previous process are removed however fresh */
+    plant("previous", 100, time.Hour)
+    plant("interrupted", 200, 0)
+    num, size := counted()
+    ns := &Namespace{Name: "sweep-test", Path: root}
+    done := make(chan struct{})
+    defer close(done)
+    ns.open(0, done)
+    for !ns.disk.scanned() { time.Sleep(time.Millisecond) }
+    if exists("previous") || exists("interrupted") { t.Fatal("temp files left after recovery") }
+    if n, b := counted(); n - num != 2 || b - size != 300 { t.Errorf("recovery counted %d files of %d bytes", n - num, b - size) }
+
+    /* uploads in progress are kept */
+    plant("stale", 400, 2 * time.Hour)
+    plant("fresh", 800, time.Minute)
+    num, size = counted()
+    ns.sweepTemp(time.Hour)
+    if exists("stale") || !exists("fresh") || !exists("dir") { t.Fatalf("swept stale %v, fresh %v, dir %v", !exists("stale"), !exists("fresh"), !exists("dir")) }
+    if n, b := counted(); n - num != 1 || b - size != 400 { t.Errorf("sweep counted %d files of %d bytes", n - num, b - size) }
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "go.uber.org/zap"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Throttle holds bandwidth limits in bytes per second, 0 means unlimited.
+// In limits p bodies received, Out limits g bodies sent.
+type Throttle struct {
+    In      int64            `json:"in"`
+    Out     int64            `json:"out"`
+    IPIn    int64            `json:"ip_in"`  // for every client ip on its own
+    IPOut   int64            `json:"ip_out"`
+    Subnets []SubnetThrottle `json:"subnets"` // shared by all clients in a subnet
+}
+
+type SubnetThrottle struct {
+    CIDR string `json:"cidr"`
+    In   int64  `json:"in"`
+    Out  int64  `json:"out"`
+}
+
+// SubnetThrottles is a flag.Value collecting repeated cidr:in:out flags
+type SubnetThrottles []SubnetThrottle
+
+func (s *SubnetThrottles) String() string {
+    var v []string
+    for _, t := range *s {
+        in, out := ByteSize(t.In), ByteSize(t.Out)
+        v = append(v, t.CIDR + ":" + in.String() + ":" + out.String())
+    }
+    return strings.Join(v, ",")
+}
+
+func (s *SubnetThrottles) Set(v string) error {
+    parts := strings.Split(v, ":")
+    if len(parts) != 3 {return fmt.Errorf("subnet throttle %q not in form of cidr:in:out", v)}
+    if _, _, err := net.ParseCIDR(parts[0]); err != nil {return err}
+    in, err := ParseByteSize(parts[1])
+    if err != nil {return err}
+    out, err := ParseByteSize(parts[2])
+    if err != nil {return err}
+    *s = append(*s, SubnetThrottle{CIDR: parts[0], In: in, Out: out})
+    return nil
+}
+
+// bucket is a token bucket holding up to one second of tokens, takers may go into debt and wait it off
+type bucket struct {
+    rate   int64
+    tokens float64
+    last   time.Time
+    sync.Mutex
+}
+
+func newBucket(rate int64) *bucket { return &bucket{rate: rate, tokens: float64(rate), last: time.Now()} }
+
+// take reserves n tokens and returns how long to wait before using them
+func (b *bucket) take(n int64) time.Duration {
+    b.Lock()
+    defer b.Unlock()
+    if b.rate <= 0 {return 0}
+    now := time.Now()
+    b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+    if b.tokens > float64(b.rate) { b.tokens = float64(b.rate) }
+    b.last = now
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {return 0}
+    return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+func (b *bucket) setRate(rate int64) {
+    b.Lock()
+    defer b.Unlock()
+    if b.tokens > float64(rate) { b.tokens = float64(rate) }
+    b.rate = rate
+}
+
+type pair struct{ in, out *bucket }
+
+func newPair(in int64, out int64) pair { return pair{in: newBucket(in), out: newBucket(out)} }
+
+func (p pair) get(out bool) *bucket {
+    if out {return p.out}
+    return p.in
+}
+
+type subnet struct {
+    *net.IPNet
+    pair
+}
+
+type peer struct {
+    pair
+    refs int
+}
+
+// throttler applies Throttle to body transfers, its config may be replaced at runtime
+type throttler struct {
+    config  Throttle
+    global  pair
+    subnets []subnet
+    peers   map[string]*peer
+    sync.RWMutex
+}
+
+func newThrottler(config Throttle) (*throttler, error) {
+    t := &throttler{global: newPair(0, 0), peers: make(map[string]*peer)}
+    return t, t.set(config)
+}
+
+func (t *throttler) set(config Throttle) error {
+    var subnets []subnet
+    for _, s := range config.Subnets {
+        _, n, err := net.ParseCIDR(s.CIDR)
+        if err != nil {return err}
+        subnets = append(subnets, subnet{IPNet: n, pair: newPair(s.In, s.Out)})
+    }
+    t.Lock()
+    defer t.Unlock()
+    t.config = config
+    t.global.in.setRate(config.In)
+    t.global.out.setRate(config.Out)
+    for _, p := range t.peers {
+        p.in.setRate(config.IPIn)
+        p.out.setRate(config.IPOut)
+    }
+    t.subnets = subnets
+    return nil
+}
+
+func (t *throttler) get() Throttle {
+    t.RLock()
+    defer t.RUnlock()
+    return t.config
+}
+
+func (t *throttler) attach(ip string) {
+    if t == nil {return}
+    t.Lock()
+    defer t.Unlock()
+    p, ok := t.peers[ip]
+    if !ok {
+        p = &peer{pair: newPair(t.config.IPIn, t.config.IPOut)}
+        t.peers[ip] = p
+    }
+    p.refs++
+}
+
+func (t *throttler) detach(ip string) {
+    if t == nil {return}
+    t.Lock()
+    defer t.Unlock()
+    if p, ok := t.peers[ip]; ok {
+        if p.refs--; p.refs <= 0 { delete(t.peers, ip) }
+    }
+}
+
+// wait blocks until n bytes may be transferred by ip in the direction given
+func (t *throttler) wait(ip string, out bool, n int64) {
+    if t == nil {return}
+    t.RLock()
+    delay := t.global.get(out).take(n)
+    if p, ok := t.peers[ip]; ok {
+        if d := p.get(out).take(n); d > delay { delay = d }
+    }
+    if len(t.subnets) > 0 {
+        addr := net.ParseIP(ip)
+        for _, s := range t.subnets {
+            if addr == nil || !s.Contains(addr) {continue}
+            if d := s.get(out).take(n); d > delay { delay = d }
+        }
+    }
+    t.RUnlock()
+    if delay <= 0 {return}
+    direction := "in"
+    if out { direction = "out" }
+    metrics.throttled.with(direction).add(delay.Milliseconds())
+    time.Sleep(delay)
+}
+
+// adminThrottle reports throttle config as JSON on GET and replaces it on PUT or POST, it's served behind
+// token check of Admin only, so that clients can't lift their own limits
+func (s *CacheServer) adminThrottle(w http.ResponseWriter, r *http.Request) {
+    s.Lock()
+    t := s.throttle
+    s.Unlock()
+    if t == nil {
+        http.Error(w, "server not listening", http.StatusServiceUnavailable)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut, http.MethodPost:
+        var config Throttle
+        if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err := t.set(config); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        logger.Info("throttle", zap.Int64("in", config.In), zap.Int64("out", config.Out), zap.Int64("ip-in", config.IPIn), zap.Int64("ip-out", config.IPOut), zap.Int("subnets", len(config.Subnets)))
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(t.get())
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func near(d time.Duration, expect time.Duration) bool {
+    return d > expect - 20 * time.Millisecond && d <= expect
+}
+
+func TestBucket(t *testing.T) {
+    b := newBucket(1000)
+    if d := b.take(1000); d != 0 {t.Fatalf("full bucket waits %v", d)}
+    if d := b.take(500); !near(d, 500 * time.Millisecond) {t.Fatalf("debt of 500 waits %v", d)}
+
+    /* refills at rate, holding one second of tokens at most */
+    b.last = b.last.Add(-time.Second)
+    if d := b.take(400); d != 0 {t.Fatalf("refilled bucket waits %v", d)}
+    b.last = b.last.Add(-time.Hour)
+    if d := b.take(1500); !near(d, 500 * time.Millisecond) {t.Fatalf("bucket overfilled, waits %v", d)}
+
+    b.setRate(0)
+    if d := b.take(1 << 30); d != 0 {t.Fatalf("unlimited bucket waits %v", d)}
+    b.setRate(100)
+    if b.tokens > 100 {t.Fatalf("tokens %v above new rate", b.tokens)}
+}
+
+func TestThrottler(t *testing.T) {
+    th, err := newThrottler(Throttle{IPOut: 1000, Subnets: []SubnetThrottle{{CIDR: "10.0.0.0/8", In: 1000}}})
+    if err != nil {t.Fatal(err)}
+    waits := func(ip string, out bool) time.Duration {
+        begin := time.Now()
+        th.wait(ip, out, 1100)
+        return time.Since(begin)
+    }
+    th.attach("192.168.1.1")
+    if d := waits("192.168.1.1", true); d < 80 * time.Millisecond {t.Fatalf("ip throttle waits %v", d)}
+    if d := waits("192.168.1.1", false); d > 50 * time.Millisecond {t.Fatalf("unlimited direction waits %v", d)}
+    if d := waits("192.168.1.2", true); d > 50 * time.Millisecond {t.Fatalf("detached ip waits %v", d)}
+    if d := waits("10.1.2.3", false); d < 80 * time.Millisecond {t.Fatalf("subnet throttle waits %v", d)}
+    th.detach("192.168.1.1")
+    if len(th.peers) != 0 {t.Fatalf("%d peers left", len(th.peers))}
+
+    if err := th.set(Throttle{Subnets: []SubnetThrottle{{CIDR: "bad"}}}); err == nil {t.Fatal("bad cidr accepted")}
+    if th.get().IPOut != 1000 {t.Fatal("config replaced by a bad one")}
+}
+
+func TestAdminThrottle(t *testing.T) {
+    s := &CacheServer{}
+    var err error
+    if s.throttle, err = newThrottler(Throttle{}); err != nil {t.Fatal(err)}
+    admin := s.Admin("secret")
+    call := func(auth string, method string, body string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(method, "/admin/throttle", bytes.NewBufferString(body))
+        if auth != "" { r.Header.Set("Authorization", "Bearer " + auth) }
+        w := httptest.NewRecorder()
+        admin.ServeHTTP(w, r)
+        return w
+    }
+    for _, auth := range []string{"", "wrong"} {
+        if w := call(auth, http.MethodPut, `{"out":1}`); w.Code != http.StatusUnauthorized {t.Fatalf("token %q: %d", auth, w.Code)}
+    }
+    if s.throttle.get().Out != 0 {t.Fatal("throttle changed without token")}
+
+    if w := call("secret", http.MethodPut, `{"out":1000,"subnets":[{"cidr":"10.0.0.0/8","in":5}]}`); w.Code != http.StatusOK {t.Fatalf("put: %d %s", w.Code, w.Body.String())}
+    w := call("secret", http.MethodGet, "")
+    var config Throttle
+    if err := json.NewDecoder(w.Body).Decode(&config); err != nil {t.Fatal(err)}
+    if config.Out != 1000 || len(config.Subnets) != 1 || config.Subnets[0].In != 5 {t.Fatalf("config %+v", config)}
+    if w := call("secret", http.MethodPut, `{"subnets":[{"cidr":"bad"}]}`); w.Code != http.StatusBadRequest {t.Fatalf("bad cidr: %d", w.Code)}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "go.uber.org/zap"
+    "hash"
+    "io"
+    "io/ioutil"
+    "strings"
+    "time"
+)
+
+// TieredStorage keeps a local read-through copy in front of a remote storage.
+// Uploads are written to both tiers, reads missing locally stream from remote and fill local tier on the way.
+// Delete and Walk only touch the local tier so that disk cache eviction leaves remote copies alone, Purge removes both.
+type TieredStorage struct {
+    Local  Storage
+    Remote Storage
+    // OnFill is called after an object is copied from remote into local tier with bytes stored, checksum sidecar included
+    OnFill func(key string, size int64)
+}
+
+func NewTieredStorage(local Storage, remote Storage) *TieredStorage {
+    return &TieredStorage{Local: local, Remote: remote}
+}
+
+func (t *TieredStorage) Get(key string) (Object, error) {
+    o, err := t.Local.Get(key)
+    if err != ErrMiss {return o, err}
+    r, err := t.Remote.Get(key)
+    if err != nil {return nil, err}
+    f := &fillObject{Object: r, t: t, key: key}
+    if f.u, err = t.Local.Put(key); err != nil {
+        logger.Error("tiered fill err", zap.String("key", key), zap.Error(err))
+        return f, nil
+    }
+    if !strings.HasSuffix(key, checksumExt) {
+        if f.sum, err = t.remoteChecksum(key); err != nil {
+            logger.Error("tiered fill checksum err", zap.String("key", key), zap.Error(err))
+            f.u.Abort() /* unverifiable copy isn't kept */
+            f.u = nil
+        } else if f.sum != nil { f.h = sha256.New() }
+    }
+    return f, nil
+}
+
+// remoteChecksum reads checksum sidecar of key from remote tier, there is none for artifacts stored before checksums
+func (t *TieredStorage) remoteChecksum(key string) ([]byte, error) {
+    o, err := t.Remote.Get(key + checksumExt)
+    if err != nil {
+        if err == ErrMiss {return nil, nil}
+        return nil, err
+    }
+    defer o.Close()
+    b, err := ioutil.ReadAll(io.LimitReader(o, 1 << 10))
+    if err != nil {return nil, err}
+    sum := make([]byte, sha256.Size)
+    if n, err := hex.Decode(sum, bytes.TrimSpace(b)); err != nil || n != len(sum) {return nil, errCorrupt}
+    return sum, nil
+}
+
+// fillObject streams a remote object while copying it into local tier, the copy is committed along with its
+// checksum once the object is read through and matches checksum of remote, corrupt remote copies are dropped
+type fillObject struct {
+    Object
+    t    *TieredStorage
+    key  string
+    u    Upload /* nil once filling is given up */
+    h    hash.Hash
+    sum  []byte
+    read int64
+}
+
+func (f *fillObject) Read(p []byte) (int, error) {
+    n, err := f.Object.Read(p)
+    if n > 0 && f.u != nil {
+        if _, e := f.u.Write(p[:n]); e != nil {
+            logger.Error("tiered fill err", zap.String("key", f.key), zap.Error(e))
+            f.u.Abort()
+            f.u = nil
+        } else if f.h != nil { f.h.Write(p[:n]) }
+    }
+    f.read += int64(n)
+    return n, err
+}
+
+func (f *fillObject) Close() error {
+    err := f.Object.Close()
+    u := f.u
+    if u == nil {return err}
+    f.u = nil
+    if f.read != f.Object.Size() {
+        u.Abort()
+        return err
+    }
+    if f.h != nil && !bytes.Equal(f.h.Sum(nil), f.sum) {
+        u.Abort()
+        logger.Error("tiered fill corrupt", zap.String("key", f.key))
+        f.t.Remote.Delete(f.key + checksumExt) /* not to be filled again */
+        f.t.Remote.Delete(f.key)
+        return errCorrupt
+    }
+    if f.sum != nil {
+        if e := writeChecksum(f.t.Local, f.key, f.sum); e != nil {
+            u.Abort()
+            return e
+        }
+    }
+    if e := u.Commit(); e != nil {
+        f.t.Local.Delete(f.key + checksumExt)
+        logger.Error("tiered fill err", zap.String("key", f.key), zap.Error(e))
+        return e
+    }
+    if f.t.OnFill != nil {
+        size := f.read
+        if f.sum != nil { size += checksumSize }
+        f.t.OnFill(f.key, size)
+    }
+    return err
+}
+
+// filling tells whether f streams from remote tier, which is verified while it's read rather than before
+func (f *File) filling() bool {
+    _, ok := f.o.(*fillObject)
+    return ok
+}
+
+// fill reads f streaming from remote tier through into local tier and reopens the local copy, so that it's verified
+// before served and corrupt remote copies are served as misses like local ones
+func (ns *Namespace) fill(f *File, key string, uuid string) (*File, error) {
+    _, err := io.Copy(ioutil.Discard, f.o)
+    if e := f.Close(); err == nil { err = e }
+    if err != nil {
+        if err == errCorrupt { metrics.corrupt.with(ns.Name).add(1) }
+        return nil, err
+    }
+    ns.disk.markVerified(key)
+    return Open(ns.store, key, uuid)
+}
+
+func (t *TieredStorage) Put(key string) (Upload, error) {
+    remote, err := t.Remote.Put(key)
+    if err != nil {return nil, err}
+    local, err := t.Local.Put(key)
+    if err != nil {
+        remote.Abort()
+        return nil, err
+    }
+    return &tieredUpload{local: local, remote: remote}, nil
+}
+
+func (t *TieredStorage) Stat(key string) (Info, error) {
+    info, err := t.Local.Stat(key)
+    if err != ErrMiss {return info, err}
+    return t.Remote.Stat(key)
+}
+
+func (t *TieredStorage) Delete(key string) error { return t.Local.Delete(key) }
+
+func (t *TieredStorage) Walk(fn func(info Info) error) error { return t.Local.Walk(fn) }
+
+func (t *TieredStorage) Touch(key string, ts time.Time) error {
+    if l, ok := t.Local.(toucher); ok {return l.Touch(key, ts)}
+    return nil
+}
+
+// Purge deletes key from both tiers, remote first so that it isn't filled again meanwhile
+func (t *TieredStorage) Purge(key string) error {
+    rerr := t.Remote.Delete(key)
+    if rerr != nil && rerr != ErrMiss {return rerr}
+    err := t.Local.Delete(key)
+    if err == ErrMiss && rerr == nil {return nil} /* only remote had it */
+    return err
+}
+
+// Quarantine takes the local copy out of service and drops the remote one, so corrupt data isn't filled again
+func (t *TieredStorage) Quarantine(key string) error {
+    if err := t.Remote.Delete(key); err != nil && err != ErrMiss {return err}
+    if q, ok := t.Local.(quarantiner); ok {return q.Quarantine(key)}
+    return t.Local.Delete(key)
+}
+
+func (t *TieredStorage) DeleteQuarantined(key string) error {
+    if q, ok := t.Local.(quarantiner); ok {return q.DeleteQuarantined(key)}
+    return ErrMiss
+}
+
+func (t *TieredStorage) WalkQuarantined(fn func(info Info) error) error {
+    if q, ok := t.Local.(quarantiner); ok {return q.WalkQuarantined(fn)}
+    return nil
+}
+
+func (t *TieredStorage) tempDir() string {
+    if l, ok := t.Local.(interface{ tempDir() string }); ok {return l.tempDir()}
+    return ""
+}
+
+type tieredUpload struct {
+    local  Upload
+    remote Upload
+}
+
+func (u *tieredUpload) Write(p []byte) (int, error) {
+    if n, err := u.remote.Write(p); err != nil {return n, err}
+    return u.local.Write(p)
+}
+
+// Commit publishes remote copy first as it's the durable one
+func (u *tieredUpload) Commit() error {
+    if err := u.remote.Commit(); err != nil {
+        u.local.Abort()
+        return err
+    }
+    return u.local.Commit()
+}
+
+func (u *tieredUpload) Abort() error {
+    u.local.Abort()
+    return u.remote.Abort()
+}
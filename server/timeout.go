@@ -0,0 +1,76 @@
+package server
+
+import (
+    "go.uber.org/zap"
+    "net"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    timeoutIdle     = "idle"     // no command arrived in time
+    timeoutChunk    = "chunk"    // a read or write within a command stalled
+    timeoutTransfer = "transfer" // an artifact body took too long
+)
+
+func deadline(timeout time.Duration, reason string, limit time.Time) (time.Time, string) {
+    var d time.Time
+    if timeout > 0 { d = time.Now().Add(timeout) }
+    if !limit.IsZero() && (d.IsZero() || limit.Before(d)) { d, reason = limit, timeoutTransfer }
+    return d, reason
+}
+
+func (c *connection) timed() bool { return c.idleTimeout > 0 || c.chunkTimeout > 0 || c.transferTimeout > 0 }
+
+func (c *connection) Read(p []byte) (int, error) {
+    n, err := c.read(p)
+    atomic.AddInt64(&c.received, int64(n))
+    return n, err
+}
+
+func (c *connection) Write(p []byte) (int, error) {
+    n, err := c.write(p)
+    atomic.AddInt64(&c.sent, int64(n))
+    return n, err
+}
+
+// read is only called by reader goroutine, which owns waiting, rlimit and rreason
+func (c *connection) read(p []byte) (int, error) {
+    if !c.timed() {return c.Conn.Read(p)}
+    for {
+        timeout, reason := c.chunkTimeout, timeoutChunk
+        if c.waiting { timeout, reason = c.idleTimeout, timeoutIdle }
+        d, reason := deadline(timeout, reason, c.rlimit)
+        c.Conn.SetReadDeadline(d)
+        n, err := c.Conn.Read(p)
+        if e, ok := err.(net.Error); ok && e.Timeout() {
+            /* client is still waiting for responses of its gets */
+            if reason == timeoutIdle && atomic.LoadInt32(&c.gets) > 0 {continue}
+            c.rreason = reason
+        }
+        return n, err
+    }
+}
+
+// write is only called by writer goroutine, which owns wlimit and wreason
+func (c *connection) write(p []byte) (int, error) {
+    if !c.timed() {return c.Conn.Write(p)}
+    d, reason := deadline(c.chunkTimeout, timeoutChunk, c.wlimit)
+    c.Conn.SetWriteDeadline(d)
+    n, err := c.Conn.Write(p)
+    if e, ok := err.(net.Error); ok && e.Timeout() { c.wreason = reason }
+    return n, err
+}
+
+// limit bounds a transfer starting now, it returns a func lifting the bound
+func (c *connection) limit(t *time.Time) func() {
+    if c.transferTimeout <= 0 {return func() {}}
+    *t = time.Now().Add(c.transferTimeout)
+    return func() { *t = time.Time{} }
+}
+
+func (c *connection) timedOut(reason string, direction string) {
+    if reason == "" {return}
+    logger.Warn("connection timeout", zap.String("addr", c.RemoteAddr().String()), zap.String("reason", reason), zap.String("direction", direction))
+    metrics.timeouts.with(c.ns.Name, reason).add(1)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "testing"
+    "time"
+)
+
+// dropped checks server closed the connection on its own within d
+func (s *session) dropped(d time.Duration) {
+    s.t.Helper()
+    s.c.SetReadDeadline(time.Now().Add(d))
+    if _, err := s.c.Read(make([]byte, 1)); err != io.EOF { s.t.Fatalf("connection not dropped: %v", err) }
+}
+
+// timedOut waits for timeouts of reason to be counted n more times than base
+func timedOut(t *testing.T, reason string, base int64, n int64) {
+    t.Helper()
+    for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+        c := metrics.timeouts.with(defaultNamespace, reason).get() - base
+        if c == n {return}
+        if time.Now().After(deadline) { t.Fatalf("%d %s timeouts, want %d", c, reason, n) }
+    }
+}
+
+func TestTimeoutIdle(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) { s.IdleTimeout = 100 * time.Millisecond })
+    base := metrics.timeouts.with(defaultNamespace, timeoutIdle).get()
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x71)
+
+    /* connection isn't idle while client is yet to read responses of its gets */
+    s.send(getCmd(RequestTypeBin, id))
+    time.Sleep(300 * time.Millisecond)
+    s.expect(miss(RequestTypeBin, id))
+    s.dropped(time.Second)
+    timedOut(t, timeoutIdle, base, 1)
+}
+
+func TestTimeoutChunk(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) { s.ChunkTimeout = 100 * time.Millisecond })
+    base := metrics.timeouts.with(defaultNamespace, timeoutChunk).get()
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x72)
+
+    /* waiting for commands isn't bound by chunk timeout */
+    time.Sleep(200 * time.Millisecond)
+    s.send("ts", id, fmt.Sprintf("p%c%016x", RequestTypeBin, 100), "stalled")
+    s.dropped(time.Second)
+    timedOut(t, timeoutChunk, base, 1)
+    if _, err := h.server.fallback().store.Stat(artifactKey(fmt.Sprintf("%x", id[:16]), fmt.Sprintf("%x", id[16:]), RequestTypeBin)); err != ErrMiss {t.Fatalf("stalled put committed: %v", err)}
+}
+
+func TestTimeoutTransfer(t *testing.T) {
+    h := newHarness(t, "pipe", func(s *CacheServer) {
+        s.ChunkTimeout = 150 * time.Millisecond
+        s.TransferTimeout = 300 * time.Millisecond
+    })
+    base := metrics.timeouts.with(defaultNamespace, timeoutTransfer).get()
+    var log bytes.Buffer
+    s := h.connect(&log)
+    id := testEntity(0x73)
+
+    /* a trickling body keeps every chunk in time but not the whole of it */
+    s.send("ts", id, fmt.Sprintf("p%c%016x", RequestTypeBin, 100))
+    begin := time.Now()
+    for i := 0; i < 100; i++ {
+        if _, err := s.c.Write([]byte{'x'}); err != nil {break}
+        time.Sleep(50 * time.Millisecond)
+    }
+    if elapse := time.Since(begin); elapse > 2 * time.Second {t.Fatalf("trickling body took %v", elapse)}
+    s.dropped(time.Second)
+    timedOut(t, timeoutTransfer, base, 1)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "go.uber.org/zap"
+    "io/ioutil"
+    "os"
+    "sync"
+    "time"
+)
+
+// certificate serves a key pair which is reloaded once either file is modified
+type certificate struct {
+    cert    string
+    key     string
+    mtime   time.Time
+    current *tls.Certificate
+    sync.RWMutex
+}
+
+func loadCertificate(cert string, key string) (*certificate, error) {
+    c := &certificate{cert: cert, key: key}
+    if _, err := c.reload(); err != nil {return nil, err}
+    return c, nil
+}
+
+func (c *certificate) modified() (time.Time, error) {
+    var mtime time.Time
+    for _, name := range []string{c.cert, c.key} {
+        info, err := os.Stat(name)
+        if err != nil {return mtime, err}
+        if info.ModTime().After(mtime) { mtime = info.ModTime() }
+    }
+    return mtime, nil
+}
+
+// reload reports whether a new key pair is in use
+func (c *certificate) reload() (bool, error) {
+    mtime, err := c.modified()
+    if err != nil {return false, err}
+    c.RLock()
+    same := c.current != nil && mtime.Equal(c.mtime)
+    c.RUnlock()
+    if same {return false, nil}
+    pair, err := tls.LoadX509KeyPair(c.cert, c.key)
+    if err != nil {return false, err}
+    c.Lock()
+    c.current = &pair
+    c.mtime = mtime
+    c.Unlock()
+    return true, nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.RLock()
+    defer c.RUnlock()
+    return c.current, nil
+}
+
+// watch polls certificate files, a broken pair keeps the previous one in use
+func (c *certificate) watch(interval time.Duration, done <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-done: return
+        }
+        if ok, err := c.reload(); err != nil {
+            metrics.tlsReloads.with("error").add(1)
+            logger.Error("tls reload err", zap.String("cert", c.cert), zap.String("key", c.key), zap.Error(err))
+        } else if ok {
+            metrics.tlsReloads.with("success").add(1)
+            logger.Info("tls reload", zap.String("cert", c.cert), zap.String("key", c.key))
+        }
+    }
+}
+
+func (s *CacheServer) tlsConfig() (*tls.Config, *certificate, error) {
+    if s.TLSCert == "" && s.TLSKey == "" {return nil, nil, nil}
+    if s.TLSCert == "" || s.TLSKey == "" {return nil, nil, fmt.Errorf("tls needs both certificate and key")}
+    cert, err := loadCertificate(s.TLSCert, s.TLSKey)
+    if err != nil {return nil, nil, err}
+    config := &tls.Config{GetCertificate: cert.get, MinVersion: tls.VersionTLS12}
+    if s.TLSClientCA != "" {
+        pem, err := ioutil.ReadFile(s.TLSClientCA)
+        if err != nil {return nil, nil, err}
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {return nil, nil, fmt.Errorf("no certificate found in %s", s.TLSClientCA)}
+        config.ClientCAs = pool
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return config, cert, nil
+}
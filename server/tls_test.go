@@ -0,0 +1,189 @@
+package server
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// testCert is a key pair written as PEM files
+type testCert struct {
+    cert     *x509.Certificate
+    key      *ecdsa.PrivateKey
+    certFile string
+    keyFile  string
+}
+
+// issue writes a certificate for localhost signed by parent, it's a self-signed CA if parent is nil
+func issue(t *testing.T, dir string, name string, parent *testCert) *testCert {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {t.Fatal(err)}
+    serial, err := rand.Int(rand.Reader, big.NewInt(1 << 62))
+    if err != nil {t.Fatal(err)}
+    template := &x509.Certificate{
+        SerialNumber: serial,
+        Subject:      pkix.Name{CommonName: name},
+        DNSNames:     []string{"localhost"},
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        BasicConstraintsValid: true,
+        IsCA:         parent == nil,
+    }
+    signer, signerKey := template, key
+    if parent != nil { signer, signerKey = parent.cert, parent.key }
+    der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+    if err != nil {t.Fatal(err)}
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {t.Fatal(err)}
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {t.Fatal(err)}
+    c := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name + ".crt"), keyFile: filepath.Join(dir, name + ".key")}
+    if err := ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {t.Fatal(err)}
+    if err := ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {t.Fatal(err)}
+    return c
+}
+
+func (c *testCert) pool() *x509.CertPool {
+    pool := x509.NewCertPool()
+    pool.AddCert(c.cert)
+    return pool
+}
+
+func (c *testCert) pair() tls.Certificate {
+    return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// tlsHarness serves a harness over TLS set up by configure, clients dial with client config.
+// It listens on loopback as handshake alerts would block on net.Pipe, which has no buffer.
+func tlsHarness(t *testing.T, configure func(s *CacheServer), client *tls.Config) *harness {
+    h := newHarness(t, "pipe", configure)
+    config, _, err := h.server.tlsConfig()
+    if err != nil {t.Fatal(err)}
+    l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+    if err != nil {t.Fatal(err)}
+    t.Cleanup(func() { l.Close() })
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {return}
+            go h.server.Handle(c)
+        }
+    }()
+    h.dial = func() net.Conn {
+        c, err := net.Dial("tcp", l.Addr().String())
+        if err != nil {t.Fatal(err)}
+        return tls.Client(c, client)
+    }
+    return h
+}
+
+// rejected checks the connection fails on handshake or on the first round trip, which is where TLS 1.3 reports client certificate errors
+func (s *session) rejected() {
+    s.t.Helper()
+    if _, err := s.c.Write([]byte("fe")); err != nil {return}
+    if _, err := io.ReadFull(s.c, make([]byte, 8)); err == nil { s.t.Fatal("connection accepted") }
+}
+
+func TestTLSHandshake(t *testing.T) {
+    dir := t.TempDir()
+    cert := issue(t, dir, "server", nil)
+    configure := func(s *CacheServer) { s.TLSCert, s.TLSKey = cert.certFile, cert.keyFile }
+    h := tlsHarness(t, configure, &tls.Config{RootCAs: cert.pool(), ServerName: "localhost"})
+    var log bytes.Buffer
+    c := h.connect(&log)
+    id := testEntity(0xd1)
+    c.send("ts", id, putCmd(RequestTypeBin, testBody(RequestTypeBin, id)), "te")
+    c.send(getCmd(RequestTypeBin, id))
+    c.expect(hit(RequestTypeBin, id, testBody(RequestTypeBin, id)))
+    c.send("qq")
+    c.closed()
+    if state := c.c.(*tls.Conn).ConnectionState(); state.Version < tls.VersionTLS12 { t.Errorf("tls version %x", state.Version) }
+
+    /* self-signed certificate isn't trusted by system roots */
+    h = tlsHarness(t, configure, &tls.Config{ServerName: "localhost"})
+    h.open(&log).rejected()
+
+    for _, v := range []*CacheServer{{TLSCert: cert.certFile}, {TLSKey: cert.keyFile}, {TLSCert: cert.keyFile, TLSKey: cert.keyFile}, {TLSCert: cert.certFile, TLSKey: cert.keyFile, TLSClientCA: cert.keyFile}} {
+        if _, _, err := v.tlsConfig(); err == nil { t.Errorf("tls config %+v accepted", v) }
+    }
+}
+
+func TestTLSClientAuth(t *testing.T) {
+    dir := t.TempDir()
+    ca := issue(t, dir, "ca", nil)
+    server := issue(t, dir, "server", ca)
+    trusted := issue(t, dir, "trusted", ca)
+    untrusted := issue(t, dir, "untrusted", nil)
+    configure := func(s *CacheServer) { s.TLSCert, s.TLSKey, s.TLSClientCA = server.certFile, server.keyFile, ca.certFile }
+    client := func(certs ...tls.Certificate) *tls.Config {
+        return &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", Certificates: certs}
+    }
+    var log bytes.Buffer
+    c := tlsHarness(t, configure, client(trusted.pair())).connect(&log)
+    c.send("qq")
+    c.closed()
+    tlsHarness(t, configure, client(untrusted.pair())).open(&log).rejected()
+    tlsHarness(t, configure, client()).open(&log).rejected()
+}
+
+func TestTLSReload(t *testing.T) {
+    dir := t.TempDir()
+    ca := issue(t, dir, "ca", nil)
+    first := issue(t, dir, "server", ca)
+    cert, err := loadCertificate(first.certFile, first.keyFile)
+    if err != nil {t.Fatal(err)}
+    done := make(chan struct{})
+    defer close(done)
+    go cert.watch(time.Millisecond, done)
+    serial := func() *big.Int {
+        t.Helper()
+        c, p := net.Pipe()
+        defer c.Close()
+        go func() {
+            defer p.Close()
+            tls.Server(p, &tls.Config{GetCertificate: cert.get}).Handshake()
+        }()
+        client := tls.Client(c, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"})
+        if err := client.Handshake(); err != nil {t.Fatal(err)}
+        return client.ConnectionState().PeerCertificates[0].SerialNumber
+    }
+    if n := serial(); n.Cmp(first.cert.SerialNumber) != 0 { t.Fatalf("serving certificate %v", n) }
+
+    /* a broken pair keeps the previous one in use */
+    reload := func(result string, write func()) {
+        t.Helper()
+        n := metrics.tlsReloads.with(result).get()
+        write()
+        future := time.Now().Add(time.Hour) /* later than any earlier modification */
+        for _, name := range []string{first.certFile, first.keyFile} {
+            if err := os.Chtimes(name, future, future); err != nil {t.Fatal(err)}
+        }
+        for deadline := time.Now().Add(5 * time.Second); metrics.tlsReloads.with(result).get() == n; time.Sleep(time.Millisecond) {
+            if time.Now().After(deadline) { t.Fatalf("no tls reload %s counted", result) }
+        }
+    }
+    reload("error", func() {
+        if err := ioutil.WriteFile(first.keyFile, []byte("broken"), 0600); err != nil {t.Fatal(err)}
+    })
+    if n := serial(); n.Cmp(first.cert.SerialNumber) != 0 { t.Fatalf("serving certificate %v after broken reload", n) }
+    var second *testCert
+    reload("success", func() { second = issue(t, dir, "server", ca) })
+    if n := serial(); n.Cmp(second.cert.SerialNumber) != 0 { t.Fatalf("serving certificate %v, want reloaded %v", n, second.cert.SerialNumber) }
+}
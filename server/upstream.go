@@ -0,0 +1,141 @@
+package server
+
+import (
+    "encoding/hex"
+    "errors"
+    "go.uber.org/zap"
+    "io"
+)
+
+var ErrMiss = errors.New("artifact not found")
+
+type Artifact struct {
+    Type   RequestType
+    Size   int64
+    Reader io.Reader
+}
+
+// Upstream is a parent cache consulted on local misses, gets are made on connection goroutines,
+// so implementations must give up on a stalled parent rather than block
+type Upstream interface {
+    // Get returns the artifact body with its size, or ErrMiss if upstream doesn't have it either
+    Get(id []byte, t RequestType) (io.ReadCloser, int64, error)
+    // Put uploads artifacts of one guid/hash within a transaction
+    Put(id []byte, artifacts []Artifact) error
+}
+
+// relay streams an upstream body to client while staging a local copy, which is committed when fully read
+type relay struct {
+    ns       *Namespace
+    body     io.ReadCloser
+    file     *File
+    key      string
+    size     int64
+    received int64
+}
+
+func (r *relay) Read(p []byte) (int, error) {
+    n, err := r.body.Read(p)
+    if n > 0 && r.file != nil {
+        if _, err := r.file.Write(p[:n]); err != nil {
+            logger.Error("upstream save err", zap.String("key", r.key), zap.Error(err))
+            r.file.Abort()
+            r.file = nil
+        }
+    }
+    r.received += int64(n)
+    return n, err
+}
+
+func (r *relay) Write(p []byte) (int, error) { return 0, errors.New("relay is read only") }
+
+func (r *relay) Close() error {
+    err := r.body.Close()
+    if r.file == nil {return err}
+    r.file.Close()
+    if r.received != r.size {
+        r.file.Abort()
+        return err
+    }
+    if err := r.file.Commit(); err != nil {
+        r.file.Abort()
+        logger.Error("upstream commit err", zap.String("key", r.key), zap.Error(err))
+        return err
+    }
+    r.ns.disk.add(r.key, r.file.footprint(r.size))
+    r.file.cache()
+    return err
+}
+
+func (ns *Namespace) fetch(ctx *Context, t RequestType, key string) (*Stream, int64, bool) {
+    body, size, err := ns.Upstream.Get(ctx.id[:], t)
+    if err != nil {
+        if err == ErrMiss { metrics.upstream.with("get", "miss").add(1) } else {
+            metrics.upstream.with("get", "error").add(1)
+            logger.Error("upstream get err", zap.String("guid", ctx.guid), zap.Error(err))
+        }
+        return nil, 0, false
+    }
+    if size == 0 {
+        body.Close()
+        metrics.upstream.with("get", "miss").add(1)
+        return nil, 0, false
+    }
+    metrics.upstream.with("get", "hit").add(1)
+    r := &relay{ns: ns, body: body, key: key, size: size}
+    if file, err := NewFile(ns.store, key, ns.uuid(ctx.Entity, t), size); err == nil { r.file = file } else {
+        logger.Error("upstream init err", zap.String("key", key), zap.Error(err))
+    }
+    logger.Debug("upstream get", zap.String("guid", ctx.guid), zap.Int64("size", size))
+    return &Stream{Rwp: r}, size, true
+}
+
+type forward struct {
+    ns        *Namespace
+    id        [32]byte
+    artifacts []*staged
+}
+
+// forwarding uploads committed transactions to upstream in background
+func (s *CacheServer) forwarding(done <-chan struct{}) {
+    for {
+        var job *forward
+        select {
+        case job = <-s.forwards:
+        case <-done: return
+        }
+        var artifacts []Artifact
+        var files []Object
+        for _, f := range job.artifacts {
+            file, err := job.ns.store.Get(f.key)
+            if err != nil {break}
+            files = append(files, file)
+            artifacts = append(artifacts, Artifact{Type: f.t, Size: f.size, Reader: file})
+        }
+        if len(artifacts) == len(job.artifacts) {
+            if err := job.ns.Upstream.Put(job.id[:], artifacts); err != nil {
+                metrics.upstream.with("put", "error").add(1)
+                logger.Error("upstream put err", zap.String("guid", hex.EncodeToString(job.id[:16])), zap.Error(err))
+            } else { metrics.upstream.with("put", "success").add(1) }
+        } else { metrics.upstream.with("put", "error").add(1) }
+        for _, file := range files { file.Close() }
+    }
+}
+
+// forwardFor starts forwarding if uploads of ns go to its upstream, s must be locked
+func (s *CacheServer) forwardFor(ns *Namespace) {
+    if ns.Upstream != nil && s.UpstreamPut && s.forwards == nil {
+        s.forwards = make(chan *forward, 256)
+        go s.forwarding(s.background().Done())
+    }
+}
+
+func (s *CacheServer) forward(ns *Namespace, trx *transaction, files []*staged) {
+    if s.forwards == nil || ns.Upstream == nil || len(files) == 0 {return}
+    select {
+    case s.forwards <- &forward{ns: ns, id: trx.id, artifacts: files}:
+    default:
+        metrics.upstream.with("put", "dropped").add(1)
+        logger.Warn("upstream put queue full", zap.String("guid", trx.guid))
+    }
+}
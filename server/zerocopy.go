@@ -0,0 +1,89 @@
+package server
+
+import (
+    "hash"
+    "io"
+    "net"
+    "os"
+    "sync/atomic"
+)
+
+// zeroCopyChunk bounds every kernel copy, so that deadlines and throttle still apply per chunk
+const zeroCopyChunk = 1 << 20
+
+// osFile is implemented by objects and uploads of storages backed by local files
+type osFile interface{ file() *os.File }
+
+func (o *fileObject) file() *os.File { return o.File }
+func (u *fileUpload) file() *os.File { return u.File }
+
+// fd exposes the local file under f for zero-copy transfers, there is none once bytes
+// have to pass through user space to fill memory cache
+func (f *File) fd() *os.File {
+    if f == nil || f.c || f.m != nil {return nil}
+    if o, ok := f.o.(osFile); ok {return o.file()}
+    if u, ok := f.u.(osFile); ok {return u.file()}
+    return nil
+}
+
+// readFrom is where the socket and file meet, the runtime turns ReadFrom of *net.TCPConn from a limited *os.File
+// into sendfile and ReadFrom of *os.File from a limited *net.TCPConn into splice, tests swap it to see both types
+var readFrom = func(dst io.ReaderFrom, src *io.LimitedReader) (int64, error) { return dst.ReadFrom(src) }
+
+// digest hashes n bytes spliced into f, they are read back from page cache rather than copied on receipt
+func digest(h hash.Hash, f *os.File, n int64, buf []byte) error {
+    _, err := io.CopyBuffer(h, io.NewSectionReader(f, 0, n), buf)
+    return err
+}
+
+// tcp exposes the plain socket under c, TLS connections have none
+func (c *connection) tcp() *net.TCPConn {
+    t, _ := c.Conn.(*net.TCPConn)
+    return t
+}
+
+// sendFile writes n bytes of f to socket
+func (c *connection) sendFile(f *os.File, n int64, t *throttler) (int64, error) {
+    tcp := c.tcp()
+    sent := int64(0)
+    for sent < n {
+        num := int64(zeroCopyChunk)
+        if n - sent < num { num = n - sent }
+        t.wait(c.ip, true, num)
+        d, reason := deadline(c.chunkTimeout, timeoutChunk, c.wlimit)
+        tcp.SetWriteDeadline(d)
+        m, err := readFrom(tcp, &io.LimitedReader{R: f, N: num})
+        if err == nil && m < num { err = io.EOF }
+        sent += m
+        atomic.AddInt64(&c.sent, m)
+        metrics.zeroCopy.with("out").add(m)
+        if err != nil {
+            if e, ok := err.(net.Error); ok && e.Timeout() { c.wreason = reason }
+            return sent, err
+        }
+    }
+    return sent, nil
+}
+
+// receiveFile reads n bytes from socket into f
+func (c *connection) receiveFile(f *os.File, n int64, t *throttler) (int64, error) {
+    tcp := c.tcp()
+    received := int64(0)
+    for received < n {
+        num := int64(zeroCopyChunk)
+        if n - received < num { num = n - received }
+        d, reason := deadline(c.chunkTimeout, timeoutChunk, c.rlimit)
+        tcp.SetReadDeadline(d)
+        m, err := readFrom(f, &io.LimitedReader{R: tcp, N: num})
+        if err == nil && m < num { err = io.EOF }
+        received += m
+        atomic.AddInt64(&c.received, m)
+        metrics.zeroCopy.with("in").add(m)
+        if err != nil {
+            if e, ok := err.(net.Error); ok && e.Timeout() { c.rreason = reason }
+            return received, err
+        }
+        t.wait(c.ip, false, m)
+    }
+    return received, nil
+}